@@ -0,0 +1,177 @@
+package r
+
+import (
+	"fmt"
+	"time"
+)
+
+const archiveBucket = "ArchiveBucket" // BoltDB bucket storing the commands pruned from each command info bucket
+
+// mergeInfo combines two command infos of the same command without
+// counting a use twice. It keeps the highest count and the latest use
+func mergeInfo(a, b *CommandInfo) *CommandInfo {
+	ci := *a
+	if b.Time.After(a.Time) {
+		ci.Time = b.Time
+		ci.Exit = b.Exit
+	}
+	if b.Count > ci.Count {
+		ci.Count = b.Count
+	}
+
+	return &ci
+}
+
+// archiveCommands moves commands pruned from the command info bucket at
+// names to its archive. A command archived before is merged
+func archiveCommands(tx Tx, cmds []*Command, names ...string) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	archive, err := openInfo(tx, true, append([]string{archiveBucket}, names...)...)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range cmds {
+		ci := cmd.Info
+		if prev := archive.get(cmd.Name); prev != nil {
+			ci = mergeInfo(prev, ci)
+		}
+
+		err = archive.put(cmd.Name, ci)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archiveGlobal moves commands pruned from the global bucket to its
+// archive and deletes their runs
+func archiveGlobal(tx Tx, cmds []*Command) error {
+	err := archiveCommands(tx, cmds, globalCommandBucket)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range cmds {
+		err = deleteRuns(tx, cmd.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ResultsArchive returns the commands pruned from the history of path
+// or, when Global is set, from the global history
+func (s *Session) ResultsArchive(path string) ([]*Command, error) {
+	if resp, ok, err := s.remote(&request{Op: "results-archive", Path: path}); ok {
+		return resp.commands(err)
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{archiveBucket, directoryBucket, path}
+	keep := inDir(path)
+	if s.Global {
+		names = []string{archiveBucket, globalCommandBucket}
+		keep = nil
+	}
+
+	var results []*Command
+	err = db.View(func(tx Tx) error {
+		results, err = s.readInfo(tx, keep, names...)
+		return err
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Restore moves cmd from every archive it's in back into the history.
+// It counts as just used so pruning doesn't archive it again straight
+// away. The least recently used commands are archived in its place
+func (s *Session) Restore(cmd string) error {
+	if _, ok, err := s.remote(&request{Op: "restore", Command: cmd}); ok {
+		return err
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx Tx) error {
+		dirLimit, globalLimit := s.HistoryLimits()
+		mode := s.sortMode()
+		now := time.Now()
+
+		restored := false
+		err := forEachInfoBucketIn(tx, []string{archiveBucket}, func(names []string, b Bucket) error {
+			archive, err := openInfo(tx, false, append([]string{archiveBucket}, names...)...)
+			if err != nil {
+				return err
+			}
+
+			ci := archive.get(cmd)
+			if ci == nil {
+				return nil
+			}
+			restored = true
+
+			ib, err := openInfo(tx, true, names...)
+			if err != nil {
+				return err
+			}
+
+			if prev := ib.get(cmd); prev != nil {
+				ci = mergeInfo(prev, ci)
+			}
+			ci.Time = now
+
+			err = ib.put(cmd, ci)
+			if err != nil {
+				return err
+			}
+
+			err = archive.delete(cmd)
+			if err != nil {
+				return err
+			}
+
+			if names[0] == globalCommandBucket {
+				return pruneInfo(tx, globalLimit, mode, names...)
+			}
+			return pruneInfo(tx, dirLimit, mode, names...)
+		})
+		if err != nil {
+			return err
+		}
+
+		if !restored {
+			return fmt.Errorf("%q isn't in the archive", cmd)
+		}
+		return nil
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
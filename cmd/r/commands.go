@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/jesselucas/r"
+)
+
+// subcommands are ran as `r <name> [flags]` and receive
+// the arguments after the name
+var subcommands = map[string]func(s *r.Session, args []string) error{
+	"db":      dbCommand,
+	"daemon":  daemonCommand,
+	"search":  searchCommand,
+	"restore": restoreCommand,
+	"import":  importCommand,
+	"export":  exportCommand,
+	"merge":   mergeCommand,
+	"sync":    syncCommand,
+	"redact":  redactCommand,
+	"pause":   pauseCommand,
+	"resume":  resumeCommand,
+}
+
+// dbCommand manages the r database: `r db migrate [--dry-run]`,
+// `r db encrypt [-keyfile path]` or `r db decrypt`
+func dbCommand(s *r.Session, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: r db migrate [--dry-run], r db encrypt [-keyfile path] or r db decrypt")
+	}
+
+	// Ask for the passphrase of an encrypted database
+	s.Unlock = unlocker(true)
+
+	switch args[0] {
+	case "encrypt", "decrypt":
+		// The database is replaced so the daemon can't hold it open
+		if conn, err := net.Dial("unix", s.Socket); err == nil {
+			conn.Close()
+			return errors.New("stop r daemon first")
+		}
+
+		if args[0] == "decrypt" {
+			err := s.Decrypt()
+			if err != nil {
+				return err
+			}
+
+			fmt.Println("Database decrypted.")
+			return nil
+		}
+
+		flags := flag.NewFlagSet("db encrypt", flag.ExitOnError)
+		keyFilePtr := flags.String("keyfile", "", "encrypt with the 32 byte key in this file, created when it doesn't exist, instead of a passphrase")
+		flags.Parse(args[1:])
+
+		err := encryptDatabase(s, *keyFilePtr)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Database encrypted.")
+		return nil
+	case "migrate":
+		flags := flag.NewFlagSet("db migrate", flag.ExitOnError)
+		dryRunPtr := flags.Bool("dry-run", false, "report what would change without writing it")
+		flags.Parse(args[1:])
+
+		changes, err := s.Migrate(*dryRunPtr)
+		if err != nil {
+			return err
+		}
+
+		if len(changes) == 0 {
+			fmt.Printf("Database is up to date (schema version %d).\n", r.SchemaVersion())
+			return nil
+		}
+
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		if *dryRunPtr {
+			fmt.Println("Dry run, nothing was changed.")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown db command %q", args[0])
+}
+
+// daemonCommand holds the database open and answers the hooks and
+// prompt over a Unix socket until it's interrupted: `r daemon`
+func daemonCommand(s *r.Session, args []string) error {
+	// Ask for the passphrase of an encrypted database once
+	// so the hooks don't have to
+	s.Unlock = unlocker(true)
+
+	// Clear a socket left behind by a daemon that didn't exit cleanly
+	if conn, err := net.Dial("unix", s.Socket); err == nil {
+		conn.Close()
+		return errors.New("r daemon is already running")
+	}
+	os.Remove(s.Socket)
+
+	// Only the user can talk to the daemon. The socket is created
+	// without permissions for others rather than changed after Listen
+	mask := syscall.Umask(0077)
+	l, err := net.Listen("unix", s.Socket)
+	syscall.Umask(mask)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-sigs
+		close(stop)
+		l.Close()
+	}()
+
+	err = s.Serve(l)
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+
+	l.Close()
+	return err
+}
+
+// searchCommand prints the commands fuzzy matching the pattern from the
+// history or the archive: `r search [-archive] [-global] [pattern]`
+func searchCommand(s *r.Session, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	archivePtr := flags.Bool("archive", false, "search the commands pruned from the history")
+	globalPtr := flags.Bool("global", false, "search all commands rather than the current directory's")
+	flags.Parse(args)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	// Search failed commands too
+	s.Global = *globalPtr
+	s.All = true
+
+	var results []*r.Command
+	switch {
+	case *archivePtr:
+		results, err = s.ResultsArchive(wd)
+	case s.Global:
+		results, err = s.ResultsGlobal()
+	default:
+		results, err = s.ResultsDirectory(wd)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, m := range s.Match(results, strings.Join(flags.Args(), " ")) {
+		fmt.Println(m.Name)
+	}
+
+	return nil
+}
+
+// restoreCommand moves a command from the archive back into the
+// history: `r restore <command>`
+func restoreCommand(s *r.Session, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: r restore <command>")
+	}
+
+	cmd := strings.Join(args, " ")
+	err := s.Restore(cmd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %q.\n", cmd)
+	return nil
+}
+
+// importCommand seeds the history from a shell history file or merges
+// an export: `r import -from bash|zsh|fish [file]` or
+// `r import -format jsonl [-conflict max|sum] [file]`
+func importCommand(s *r.Session, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	fromPtr := flags.String("from", "", "shell whose history file is read: bash, zsh or fish")
+	formatPtr := flags.String("format", "", "read an export of r in this format: jsonl")
+	conflictPtr := flags.String("conflict", r.MergeMax, "how commands already stored are merged with -format: max keeps the highest count, sum adds the counts")
+	flags.Parse(args)
+
+	if (*fromPtr == "") == (*formatPtr == "") || flags.NArg() > 1 {
+		return errors.New("usage: r import -from bash|zsh|fish [file] or r import -format jsonl [-conflict max|sum] [file]")
+	}
+
+	if *formatPtr != "" {
+		if *formatPtr != "jsonl" {
+			return fmt.Errorf("unknown format %q. Use jsonl", *formatPtr)
+		}
+
+		// Read the export from stdin without a file
+		in := os.Stdin
+		if path := flags.Arg(0); path != "" && path != "-" {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+
+		records, err := r.ReadRecords(in)
+		if err != nil {
+			return err
+		}
+
+		err = s.ImportRecords(records, *conflictPtr)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Imported %d records.\n", len(records))
+		return nil
+	}
+
+	path := flags.Arg(0)
+	if path == "" {
+		var err error
+		path, err = historyPath(*fromPtr)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	cmds, skipped, err := r.ParseHistory(*fromPtr, f, info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	n, err := s.Import(cmds)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d of %d commands from %s.\n", n, len(cmds), path)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d multi-line commands.\n", skipped)
+	}
+	if _, globalLimit := s.HistoryLimits(); n > globalLimit {
+		fmt.Printf("Commands past R_GLOBALHISTORY (%d) are archived when the next command is stored. Raise it to keep them in the history.\n", globalLimit)
+	}
+	return nil
+}
+
+// exportCommand writes the whole database as JSON Lines to
+// the file or stdout: `r export [file]`
+func exportCommand(s *r.Session, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: r export [file]")
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		return s.Export(os.Stdout)
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = s.Export(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// rewriteFlags collects the repeated -rewrite flags of merge
+type rewriteFlags []r.Rewrite
+
+func (f *rewriteFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *rewriteFlags) Set(value string) error {
+	rw, err := r.ParseRewrite(value)
+	if err != nil {
+		return err
+	}
+
+	*f = append(*f, rw)
+	return nil
+}
+
+// mergeCommand folds another r database into this one:
+// `r merge [-rewrite /Users/me=/home/me] other.db`
+func mergeCommand(s *r.Session, args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	var rewrites rewriteFlags
+	flags.Var(&rewrites, "rewrite", "replace a directory prefix of the other database, ex. /Users/me=/home/me (repeatable)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: r merge [-rewrite from=to] other.db")
+	}
+
+	n, err := s.Merge(flags.Arg(0), rewrites)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Merged %d records from %s.\n", n, flags.Arg(0))
+	return nil
+}
+
+// redactCommand masks the secrets of the history already stored or
+// shows how a command would be stored: `r redact --rescan` or
+// `r redact <command>`
+func redactCommand(s *r.Session, args []string) error {
+	flags := flag.NewFlagSet("redact", flag.ExitOnError)
+	rescanPtr := flags.Bool("rescan", false, "redact the commands already stored")
+	flags.Parse(args)
+
+	if *rescanPtr == (flags.NArg() > 0) {
+		return errors.New("usage: r redact --rescan or r redact <command>")
+	}
+
+	if *rescanPtr {
+		n, err := s.Rescan()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Redacted %d commands.\n", n)
+		return nil
+	}
+
+	cmd, found, err := s.Redact(strings.Join(flags.Args(), " "))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !found:
+		fmt.Println("No secret found.")
+	case cmd == "":
+		fmt.Println("Skipped, the command has a secret.")
+	default:
+		fmt.Println(cmd)
+	}
+	return nil
+}
+
+// pauseCommand stops recording the commands of this shell until
+// `r resume`: `r pause`. The hook's r function sets R_PAUSED in the shell
+// so the pause ends with it
+func pauseCommand(s *r.Session, args []string) error {
+	if os.Getenv("R_PAUSED") == "" {
+		return errors.New("r pause needs the r hook. Run r -install and restart your shell")
+	}
+
+	fmt.Println("Recording paused for this shell. Run r resume to record again.")
+	return nil
+}
+
+// resumeCommand records the commands of this shell again: `r resume`
+func resumeCommand(s *r.Session, args []string) error {
+	fmt.Println("Recording resumed for this shell.")
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jesselucas/r"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// scrypt cost parameters for keys derived from a passphrase
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// secretboxCipher seals with NaCl secretbox. Keys are sealed with a nonce
+// derived from the key so they can be looked up, values with a random one
+type secretboxCipher struct {
+	key      [32]byte
+	nonceKey []byte
+}
+
+// newSecretboxCipher returns a cipher sealing with the 32 byte key
+func newSecretboxCipher(key []byte) (*secretboxCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("keys are 32 bytes, got %d", len(key))
+	}
+
+	c := new(secretboxCipher)
+	copy(c.key[:], key)
+
+	// Nonces of keys don't reveal the secretbox key
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("r key nonce"))
+	c.nonceKey = mac.Sum(nil)
+
+	return c, nil
+}
+
+func (c *secretboxCipher) seal(nonce *[24]byte, message []byte) []byte {
+	return secretbox.Seal(nonce[:], message, nonce, &c.key)
+}
+
+func (c *secretboxCipher) SealKey(key []byte) []byte {
+	var nonce [24]byte
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(key)
+	copy(nonce[:], mac.Sum(nil))
+
+	return c.seal(&nonce, key)
+}
+
+func (c *secretboxCipher) Seal(value []byte) []byte {
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return c.seal(&nonce, value)
+}
+
+func (c *secretboxCipher) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < 24+secretbox.Overhead {
+		return nil, errors.New("sealed value is too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	opened, ok := secretbox.Open(nil, sealed[24:], &nonce, &c.key)
+	if !ok {
+		return nil, errors.New("can't open sealed value")
+	}
+
+	return opened, nil
+}
+
+// keyFileParams are the params of a database encrypted with the key
+// file at path. R_KEYFILE overrides the path when the database is opened
+func keyFileParams(path string) []byte {
+	return []byte("keyfile " + path)
+}
+
+// passphraseParams are the params of a database encrypted with a key
+// derived from a passphrase with scrypt and salt
+func passphraseParams(salt []byte) []byte {
+	return []byte(fmt.Sprintf("scrypt %d %d %d %s", scryptN, scryptR, scryptP, base64.StdEncoding.EncodeToString(salt)))
+}
+
+// unlocker returns the Unlock function of the Session. Databases
+// encrypted with a passphrase are only unlocked when prompt is set
+// since the hooks can't ask for it
+func unlocker(prompt bool) func(params []byte) (r.Cipher, error) {
+	return func(params []byte) (r.Cipher, error) {
+		fields := strings.Fields(string(params))
+		if len(fields) == 0 {
+			return nil, errors.New("the r database is encrypted with an unknown key")
+		}
+
+		switch fields[0] {
+		case "keyfile":
+			// The path can have spaces
+			path := os.Getenv("R_KEYFILE")
+			if path == "" {
+				path = strings.TrimPrefix(string(params), "keyfile ")
+			}
+
+			key, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			return newSecretboxCipher(key)
+		case "scrypt":
+			if len(fields) != 5 {
+				break
+			}
+			if !prompt {
+				return nil, errors.New("the r database is encrypted with a passphrase. Start r daemon to unlock it")
+			}
+
+			cost, errN := strconv.Atoi(fields[1])
+			blockSize, errR := strconv.Atoi(fields[2])
+			parallel, errP := strconv.Atoi(fields[3])
+			salt, errSalt := base64.StdEncoding.DecodeString(fields[4])
+			if errN != nil || errR != nil || errP != nil || errSalt != nil {
+				break
+			}
+
+			passphrase, err := readPassphrase("Passphrase of the r database: ")
+			if err != nil {
+				return nil, err
+			}
+
+			key, err := scrypt.Key(passphrase, salt, cost, blockSize, parallel, 32)
+			if err != nil {
+				return nil, err
+			}
+			return newSecretboxCipher(key)
+		}
+
+		return nil, fmt.Errorf("the r database is encrypted with an unknown key %q", params)
+	}
+}
+
+// readPassphrase asks for a passphrase on the terminal without echoing it
+func readPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, errors.New("a passphrase can only be read from a terminal")
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// encryptDatabase encrypts the database with the key file at keyFile,
+// created when it doesn't exist, or with a passphrase
+func encryptDatabase(s *r.Session, keyFile string) error {
+	if keyFile != "" {
+		path, err := filepath.Abs(keyFile)
+		if err != nil {
+			return err
+		}
+
+		key, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			key = make([]byte, 32)
+			_, err = rand.Read(key)
+			if err == nil {
+				err = ioutil.WriteFile(path, key, 0600)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		c, err := newSecretboxCipher(key)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return s.Encrypt(c, keyFileParams(path))
+	}
+
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return err
+	}
+
+	again, err := readPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(passphrase, again) {
+		return errors.New("the passphrases don't match")
+	}
+
+	salt := make([]byte, 16)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return err
+	}
+
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return err
+	}
+
+	c, err := newSecretboxCipher(key)
+	if err != nil {
+		return err
+	}
+	return s.Encrypt(c, passphraseParams(salt))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jesselucas/r"
+)
+
+func TestSecretboxCipher(t *testing.T) {
+	c, err := newSecretboxCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("git status")
+	if !bytes.Equal(c.SealKey(key), c.SealKey(key)) {
+		t.Error("keys should be sealed the same way every time")
+	}
+	if bytes.Equal(c.Seal(key), c.Seal(key)) {
+		t.Error("values should be sealed with a random nonce")
+	}
+
+	for _, sealed := range [][]byte{c.SealKey(key), c.Seal(key)} {
+		if bytes.Contains(sealed, key) {
+			t.Error("sealed value shouldn't contain plaintext")
+		}
+
+		opened, err := c.Open(sealed)
+		if err != nil || !bytes.Equal(opened, key) {
+			t.Errorf("open should return %q, got %q, %v", key, opened, err)
+		}
+	}
+
+	other, err := newSecretboxCipher(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(c.Seal(key)); err == nil {
+		t.Error("opening with another key should fail")
+	}
+
+	if _, err := newSecretboxCipher([]byte("short")); err == nil {
+		t.Error("a key that isn't 32 bytes should fail")
+	}
+}
+
+func TestEncryptKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "r-crypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := new(r.Session)
+	s.BoltPath = filepath.Join(dir, "r.db")
+	s.Unlock = unlocker(false)
+	err = s.AddRun("ls -a", &r.Run{Dir: "/tmp", Start: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "r.key")
+	err = encryptDatabase(s, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(s.BoltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("ls -a")) {
+		t.Error("the encrypted database shouldn't contain plaintext")
+	}
+
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "ls -a" {
+		t.Error("the key file should unlock the database without prompting, got", len(results))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runBashHook runs lines in an interactive bash with the r hook and
+// returns the exit status and command the hook sent to r for each
+// command line
+func runBashHook(t *testing.T, lines ...string) []string {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// r logs the exit status and the command it's sent, each followed by
+	// a NUL, and picks $R_PICKED
+	stub := "#!/bin/sh\ncase \"$*\" in\n" +
+		"*--add*) printf '%s ' \"$4\" >> \"$R_LOG\"; cat >> \"$R_LOG\"; printf '\\0' >> \"$R_LOG\";;\n" +
+		"*--command*) printf '%s' \"$R_PICKED\";;\n" +
+		"esac\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "r"), []byte(stub), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := filepath.Join(dir, rSourceName)
+	err = ioutil.WriteFile(hook, []byte(rBashFile), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := filepath.Join(dir, "log")
+	input := "source " + hook + "\n" + strings.Join(lines, "\n") + "\nexit\n"
+
+	cmd := exec.Command(bash, "--norc", "--noprofile", "-i")
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + dir + ":" + os.Getenv("PATH"),
+		"HOME=" + dir,
+		"HISTFILE=" + filepath.Join(dir, "history"),
+		"HISTCONTROL=ignoreboth",
+		"R_LOG=" + log,
+	}
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err, stderr.String())
+	}
+	if strings.Contains(stderr.String(), "syntax error") {
+		t.Error("the hook failed:", stderr.String())
+	}
+
+	sent, err := ioutil.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(sent), "\x00"), "\x00")
+}
+
+func TestBashHook(t *testing.T) {
+	sent := runBashHook(t,
+		"touch a.go b.go",
+		"true one",
+		"2nope foo",
+		`echo *.go "x  y" | cat && true`,
+		"",
+		`echo *.go "x  y" | cat && true`,
+		" true secret",
+		"r pause",
+		"true paused",
+		"r resume",
+		"true resumed",
+		"export R_PICKED='false picked'",
+		"r",
+	)
+
+	// The picked command is sent once it ran
+	expected := []string{
+		"0 touch a.go b.go",
+		"0 true one",
+		"127 2nope foo",
+		`0 echo *.go "x  y" | cat && true`,
+		`0 echo *.go "x  y" | cat && true`,
+		"0  true secret",
+		"0 r resume",
+		"0 true resumed",
+		"0 export R_PICKED='false picked'",
+		"0 r",
+		"1 false picked",
+	}
+	if strings.Join(sent, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("the command lines should be sent as typed, expected %q, got %q", expected, sent)
+	}
+}
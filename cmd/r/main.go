@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,13 +12,33 @@ import (
 
 	"github.com/chzyer/readline"
 	"github.com/jesselucas/r"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	rSourceName = ".r.sh" // File name of Bash script
+	rSourceName     = ".r.sh"  // File name of Bash script
+	rZshSourceName  = ".r.zsh" // File name of zsh script
+	rFishSourceName = "r.fish" // File name of fish script in conf.d
 )
 
 func main() {
+	// Subcommands have their own flags so run them before parsing
+	if len(os.Args) > 1 {
+		if sub, ok := subcommands[os.Args[1]]; ok {
+			s, err := newSession()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			err = sub(s, os.Args[2:])
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
+
 	// Setup flags
 	globalUsage := "show all commands stored"
 	globalPtr := flag.Bool("global", false, globalUsage)
@@ -27,40 +48,52 @@ func main() {
 	versionPtr := flag.Bool("version", false, versionUsage)
 	flag.BoolVar(versionPtr, "v", false, versionUsage+" (shorthand)")
 
-	// Change sorting flag based on environment variables
-	var sortTimePtr *bool
-	var sortUsagePtr *bool
+	// Sorting flags override the default set by environment variables
+	sortTimeUsage := "sort commands by last used"
+	sortTimePtr := flag.Bool("time", false, sortTimeUsage)
+	flag.BoolVar(sortTimePtr, "t", false, sortTimeUsage+" (shorthand)")
 
-	if os.Getenv("R_SORTBYUSAGE") == "1" {
-		sortTimeUsage := "sort commands by directory"
-		sortTimePtr = flag.Bool("time", false, sortTimeUsage)
-		flag.BoolVar(sortTimePtr, "t", false, sortTimeUsage+" (shorthand)")
-	} else {
-		sortUsageUsage := "sort commands by usage rather than last used"
-		sortUsagePtr = flag.Bool("usage", false, sortUsageUsage)
-		flag.BoolVar(sortUsagePtr, "u", false, sortUsageUsage+" (shorthand)")
-	}
+	sortUsageUsage := "sort commands by usage rather than last used"
+	sortUsagePtr := flag.Bool("usage", false, sortUsageUsage)
+	flag.BoolVar(sortUsagePtr, "u", false, sortUsageUsage+" (shorthand)")
+
+	sortFrecencyUsage := "sort commands by frecency, a mix of usage and last used"
+	sortFrecencyPtr := flag.Bool("frecency", false, sortFrecencyUsage)
+	flag.BoolVar(sortFrecencyPtr, "f", false, sortFrecencyUsage+" (shorthand)")
+
+	treePtr := flag.Bool("tree", false, "include history from parent directories up to the project root")
+	descendantsPtr := flag.Bool("descendants", false, "include history from child directories (implies -tree)")
+
+	repoPtr := flag.Bool("repo", false, "show history of the git repository from every clone and worktree")
+
+	failedPtr := flag.Bool("failed", false, "show only commands that failed the last time they ran")
+	allPtr := flag.Bool("all", false, "show commands whether they failed or succeeded")
+	limitPtr := flag.Int("limit", 0, "show at most this many commands (0 shows all)")
 
 	commandPtr := flag.Bool("command", false, "show last command selected")
-	addPtr := flag.String("add", "", "adds command and path to history")
-	installPtr := flag.Bool("install", false, fmt.Sprintf("installs %s to .bashrc", rSourceName))
+	addPtr := flag.String("add", "", "adds command to history, - reads it from stdin")
+	cwdPtr := flag.String("cwd", "", "working directory of the added command")
+	sessionPtr := flag.String("session", os.Getenv("R_SESSION"), "shell session of the added command")
+	durationPtr := flag.Duration("duration", 0, "how long the added command took to run")
+	exitPtr := flag.Int("exit", 0, "exit status of the added command")
+	installPtr := flag.Bool("install", false, fmt.Sprintf("installs %s to .bashrc, %s to .zshrc and %s to fish conf.d", rSourceName, rZshSourceName, rFishSourceName))
 	flag.Parse()
 
 	// Create new r Session
-	s := new(r.Session)
-	if os.Getenv("R_SORTBYUSAGE") == "1" {
-		s.SortTime = *sortTimePtr
-	} else {
-		s.SortUsage = *sortUsagePtr
-	}
-	s.Global = *globalPtr
-
-	// Setup bolt db path
-	homeDir, err := homeDirectory()
+	s, err := newSession()
 	if err != nil {
 		log.Fatal(err)
 	}
-	s.BoltPath = filepath.Join(homeDir, ".r.db")
+	s.SortTime = *sortTimePtr
+	s.SortUsage = *sortUsagePtr
+	s.SortFrecency = *sortFrecencyPtr
+	s.Global = *globalPtr
+	s.Tree = *treePtr || *descendantsPtr
+	s.Descendants = *descendantsPtr
+	s.Repo = *repoPtr
+	s.Failed = *failedPtr
+	s.All = *allPtr
+	s.Limit = *limitPtr
 
 	if *commandPtr {
 		err = s.PrintLastCommand()
@@ -72,13 +105,20 @@ func main() {
 
 	// Check if `add` flag is passed
 	if *addPtr != "" {
-		args := strings.Split(*addPtr, "^_")
-		if len(args) != 2 {
-			fmt.Println("Could not add command.")
-			os.Exit(1)
+		e := &r.Execution{
+			Command:  *addPtr,
+			Dir:      *cwdPtr,
+			Exit:     *exitPtr,
+			Duration: *durationPtr,
+			Session:  *sessionPtr,
 		}
 
-		err := s.Add(args[0], args[1])
+		err := readExecution(e)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = s.Add(e)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -118,8 +158,29 @@ func main() {
 	readLine(s)
 }
 
-// readLine used the readline library create a prompt to
-// show the command history
+// newSession creates an r Session using the bolt db in the home directory
+// and the r daemon when it's running
+func newSession() (*r.Session, error) {
+	homeDir, err := homeDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(r.Session)
+	s.BoltPath = filepath.Join(homeDir, ".r.db")
+
+	s.Socket = os.Getenv("R_SOCKET")
+	if s.Socket == "" {
+		s.Socket = filepath.Join(homeDir, ".r.sock")
+	}
+
+	// Only databases encrypted with a key file open without the daemon
+	s.Unlock = unlocker(false)
+	return s, nil
+}
+
+// readLine shows the command history in the fuzzy picker or, when
+// stdin isn't a terminal, in a readline prompt
 func readLine(s *r.Session) {
 	// Create completer from results
 	wd, err := os.Getwd()
@@ -128,7 +189,17 @@ func readLine(s *r.Session) {
 	}
 
 	var results []*r.Command
-	if !s.Global {
+	if s.Repo && !s.Global {
+		results, err = s.ResultsRepo(wd)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else if s.Tree && !s.Global {
+		results, err = s.ResultsTree(wd)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else if !s.Global {
 		results, err = s.ResultsDirectory(wd)
 		if err != nil {
 			log.Panic(err)
@@ -140,6 +211,20 @@ func readLine(s *r.Session) {
 		}
 	}
 
+	// Use the fuzzy picker when r is ran from a terminal
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := pick(s, wd, results)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		line = strings.TrimSpace(line)
+		if line != "" {
+			runLine(s, line)
+		}
+		return
+	}
+
 	var pcItems []readline.PrefixCompleterInterface
 	for _, result := range results {
 		pcItems = append(pcItems, readline.PcItem(result.Name))
@@ -163,55 +248,81 @@ func readLine(s *r.Session) {
 
 		line = strings.TrimSpace(line)
 
-		// Only execute if the command typed is in the list of results
-		// cmdNames := namesOfCmds(results)
-		// if !containsCmd(line, cmdNames) {
-		// 	fmt.Println("Command not found in `r` history.")
-		// 	os.Exit(0)
-		// }
+		runLine(s, line)
+	}
+}
 
-		// The command was found and will be executed so add it to the DB to update
-		wd, err := os.Getwd()
-		if err != nil {
-			fmt.Println("Error executing command.")
-			os.Exit(1)
-		}
-		s.Add(wd, line)
+// runLine stores the selected line so the shell hook executes it. The
+// hook adds it to the history once it ran with its exit status
+func runLine(s *r.Session, line string) {
+	err := s.StoreLastCommand(line)
+	if err != nil {
+		fmt.Println("Error storing command.")
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
 
+// readExecution completes the command and directory of e sent by the
+// hook. A - command is read from stdin so it can be of any length and
+// have any character. Hooks of older versions send the directory and
+// the command separated by ^_ without --cwd
+func readExecution(e *r.Execution) error {
+	switch {
+	case e.Command == "-":
+		cmd, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
-			fmt.Println("Error storing command.")
-			os.Exit(1)
+			return err
+		}
+		e.Command = string(cmd)
+	case e.Dir == "":
+		// Only the first ^_ separates the directory, commands can have one
+		args := strings.SplitN(e.Command, "^_", 2)
+		if len(args) != 2 {
+			return fmt.Errorf("no directory for %q. Pass it with --cwd", e.Command)
 		}
+		e.Dir, e.Command = args[0], args[1]
+	}
 
-		// Store last command
-		err = s.StoreLastCommand(line)
+	if e.Dir == "" {
+		wd, err := os.Getwd()
 		if err != nil {
-			fmt.Println("Error storing command.")
-			os.Exit(1)
+			return err
 		}
-
-		os.Exit(0)
+		e.Dir = wd
 	}
+
+	return nil
 }
 
-// Install will take add .r.sh to you Bash config
+// Install will add the r hook script to the config of
+// every shell found in the home directory
 func install() error {
-	if installed() {
-		fmt.Println("r is already installed.")
-		return nil
-	}
+	found := false
+	for _, sh := range shells {
+		path, err := sh.rcPath()
+		if err != nil {
+			continue
+		}
+		found = true
 
-	// install .r.sh
-	path, err := bashPath()
-	if err == nil {
-		err = sourceR(path)
+		if sh.installed(path) {
+			fmt.Printf("r is already installed for %s.\n", sh.name)
+			continue
+		}
+
+		err = sh.source(path)
 		if err != nil {
 			return err
 		}
 
-		fmt.Println("r successfully installed! Restart your bash shell.")
-		return nil
+		fmt.Printf("r successfully installed for %s! Restart your %s shell.\n", sh.name, sh.name)
+	}
+
+	if !found {
+		return errors.New("Could not install r")
 	}
 
-	return errors.New("Could not install r")
+	return nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jesselucas/r"
+)
+
+func TestReadExecution(t *testing.T) {
+	// The command is read from stdin for -
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	cmd := "cat <<EOF\na^_b\nEOF"
+	_, err = f.WriteString(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = f
+	defer func() {
+		os.Stdin = stdin
+	}()
+
+	e := &r.Execution{Command: "-", Dir: "/tmp"}
+	err = readExecution(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Command != cmd || e.Dir != "/tmp" {
+		t.Errorf("the command should be read from stdin, got %q in %q", e.Command, e.Dir)
+	}
+
+	// Older hooks send the directory and the command separated by ^_
+	e = &r.Execution{Command: "/tmp^_echo a^_b"}
+	err = readExecution(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Command != "echo a^_b" || e.Dir != "/tmp" {
+		t.Errorf("only the first ^_ should separate the directory, got %q in %q", e.Command, e.Dir)
+	}
+
+	// --cwd is needed without ^_
+	if readExecution(&r.Execution{Command: "ls"}) == nil {
+		t.Error("a command without a directory should fail")
+	}
+
+	// The working directory is used for - without --cwd
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e = &r.Execution{Command: "-"}
+	err = readExecution(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Dir != wd {
+		t.Errorf("the directory should be %q, got %q", wd, e.Dir)
+	}
+}
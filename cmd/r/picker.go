@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jesselucas/r"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Escape sequences used to draw the picker
+const (
+	altScreenOn  = "\x1b[?1049h"
+	altScreenOff = "\x1b[?1049l"
+	clearLine    = "\x1b[K"
+	highlight    = "\x1b[1;33m" // Bold yellow for matched characters
+	selected     = "\x1b[7m"    // Reverse video for the selected row
+	dim          = "\x1b[2m"    // Faint text for the command info
+	reset        = "\x1b[0m"
+	pickerPrompt = "r> "
+)
+
+// picker is a full-screen selector that fuzzy matches the
+// command history as the query is typed
+type picker struct {
+	s       *r.Session
+	wd      string // Directory commands are labelled relative to
+	results []*r.Command
+	matches []*r.Match
+	query   []rune
+	cursor  int // Index of the selected match
+	offset  int // Index of the first match shown
+	width   int
+	height  int
+	out     *bufio.Writer
+}
+
+// pick shows the picker on the terminal and returns the selected
+// command. It returns an empty string when the picker is cancelled
+func pick(s *r.Session, wd string, results []*r.Command) (string, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer terminal.Restore(fd, state)
+
+	p := &picker{
+		s:       s,
+		wd:      wd,
+		results: results,
+		out:     bufio.NewWriter(os.Stdout),
+	}
+	p.out.WriteString(altScreenOn)
+	defer func() {
+		p.out.WriteString(altScreenOff)
+		p.out.Flush()
+	}()
+
+	p.filter()
+
+	buf := make([]byte, 256)
+	for {
+		p.width, p.height, err = terminal.GetSize(fd)
+		if err != nil {
+			return "", err
+		}
+		if p.width == 0 || p.height == 0 {
+			p.width, p.height = 80, 24
+		}
+		p.draw()
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		line, done := p.handle(buf[:n])
+		if done {
+			return line, nil
+		}
+	}
+}
+
+// handle applies the keys read from the terminal. It returns true
+// and the selected command once the picker is done
+func (p *picker) handle(keys []byte) (string, bool) {
+	for len(keys) > 0 {
+		// Escape sequences for the arrow and page keys
+		if keys[0] == 0x1b {
+			if len(keys) == 1 {
+				return "", true // Esc
+			}
+
+			n := 2
+			for n < len(keys) && (keys[n] < 0x40 || keys[n] > 0x7e) {
+				n++
+			}
+			if n < len(keys) {
+				n++
+			}
+
+			switch string(keys[:n]) {
+			case "\x1b[A", "\x1bOA", "\x1b[Z":
+				p.move(-1)
+			case "\x1b[B", "\x1bOB":
+				p.move(1)
+			case "\x1b[5~":
+				p.move(-p.rows())
+			case "\x1b[6~":
+				p.move(p.rows())
+			}
+
+			keys = keys[n:]
+			continue
+		}
+
+		c, size := utf8.DecodeRune(keys)
+		keys = keys[size:]
+
+		switch c {
+		case '\r', '\n':
+			return p.selected(), true
+		case 0x03, 0x04: // Ctrl-C, Ctrl-D
+			return "", true
+		case 0x7f, 0x08: // Backspace
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.filter()
+			}
+		case 0x15: // Ctrl-U
+			p.query = nil
+			p.filter()
+		case 0x17: // Ctrl-W
+			q := strings.TrimRightFunc(string(p.query), unicode.IsSpace)
+			i := strings.LastIndexFunc(q, unicode.IsSpace)
+			p.query = []rune(q[:i+1])
+			p.filter()
+		case 0x10, 0x0b: // Ctrl-P, Ctrl-K
+			p.move(-1)
+		case 0x0e, '\t': // Ctrl-N, Tab
+			p.move(1)
+		default:
+			if unicode.IsPrint(c) {
+				p.query = append(p.query, c)
+				p.filter()
+			}
+		}
+	}
+
+	return "", false
+}
+
+// selected returns the name of the selected match. With no matches
+// the query itself is used as the command
+func (p *picker) selected() string {
+	if len(p.matches) == 0 {
+		return string(p.query)
+	}
+
+	return p.matches[p.cursor].Name
+}
+
+// filter matches the results against the query and selects the best match
+func (p *picker) filter() {
+	p.matches = p.s.Match(p.results, string(p.query))
+	p.cursor = 0
+	p.offset = 0
+}
+
+// rows is the number of matches that fit below the prompt
+func (p *picker) rows() int {
+	if p.height < 2 {
+		return 1
+	}
+	return p.height - 1
+}
+
+// move the selection by n rows keeping it on screen
+func (p *picker) move(n int) {
+	p.cursor += n
+	if p.cursor >= len(p.matches) {
+		p.cursor = len(p.matches) - 1
+	}
+	if p.cursor < 0 {
+		p.cursor = 0
+	}
+
+	if p.cursor < p.offset {
+		p.offset = p.cursor
+	}
+	if p.cursor >= p.offset+p.rows() {
+		p.offset = p.cursor - p.rows() + 1
+	}
+}
+
+// draw renders the prompt and the visible matches
+func (p *picker) draw() {
+	// Selection could be off screen after a resize
+	p.move(0)
+
+	status := fmt.Sprintf("%d/%d", len(p.matches), len(p.results))
+	prompt := pickerPrompt + string(p.query)
+	fmt.Fprintf(p.out, "\x1b[1;1H%s%s", prompt, clearLine)
+	if pad := p.width - utf8.RuneCountInString(prompt) - len(status); pad > 0 {
+		fmt.Fprintf(p.out, "%s%s%s%s", strings.Repeat(" ", pad), dim, status, reset)
+	}
+
+	for row := 0; row < p.rows(); row++ {
+		fmt.Fprintf(p.out, "\x1b[%d;1H%s", row+2, clearLine)
+
+		i := p.offset + row
+		if i < len(p.matches) {
+			p.drawMatch(p.matches[i], i == p.cursor)
+		}
+	}
+
+	// Put the cursor back at the end of the query
+	fmt.Fprintf(p.out, "\x1b[1;%dH", utf8.RuneCountInString(prompt)+1)
+	p.out.Flush()
+}
+
+// drawMatch renders a single match with its matched characters
+// highlighted and the command info aligned to the right
+func (p *picker) drawMatch(m *r.Match, isSelected bool) {
+	info := fmt.Sprintf("%dx %s", m.Info.Count, ago(m.Info.Time))
+	if m.Info.Failed() {
+		info = fmt.Sprintf("exit %d  %s", m.Info.Exit, info)
+	}
+
+	// Label commands from other directories
+	if m.Dir != "" && m.Dir != p.wd {
+		if rel, err := filepath.Rel(p.wd, m.Dir); err == nil {
+			info = fmt.Sprintf("%s  %s", rel, info)
+		}
+	}
+
+	style := ""
+	if isSelected {
+		style = selected
+	}
+
+	// Leave room for the marker and info
+	info = string(printable(info))
+	room := p.width - utf8.RuneCountInString(info) - 4
+	if room < 1 {
+		room = 1
+	}
+
+	marker := "  "
+	if isSelected {
+		marker = "> "
+	}
+	p.out.WriteString(style + marker)
+
+	name, n := renderName(m.Name, m.Positions, room, style)
+	p.out.WriteString(name)
+
+	pad := p.width - n - utf8.RuneCountInString(info) - 2
+	if pad < 1 {
+		pad = 1
+	}
+	p.out.WriteString(strings.Repeat(" ", pad) + dim + style + info + reset)
+}
+
+// printable returns the runes of s with control characters replaced by a
+// visible placeholder so a stored command can't break the layout or send
+// escape sequences to the terminal
+func printable(s string) []rune {
+	runes := []rune(s)
+	for i, c := range runes {
+		switch {
+		case c == '\n':
+			runes[i] = '↵'
+		case c == '\t':
+			runes[i] = '→'
+		case unicode.IsControl(c):
+			runes[i] = '·'
+		}
+	}
+
+	return runes
+}
+
+// renderName returns name cut to room runes with the runes at positions
+// highlighted, style being restored after each, and how many runes it shows
+func renderName(name string, positions []int, room int, style string) (string, int) {
+	runes := printable(name)
+	if len(runes) > room {
+		runes = runes[:room]
+	}
+
+	var b strings.Builder
+	for i, c := range runes {
+		if len(positions) > 0 && positions[0] == i {
+			positions = positions[1:]
+			b.WriteString(highlight + string(c) + reset + style)
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String(), len(runes)
+}
+
+// ago formats how long ago t was in a short form
+func ago(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	case d < 30*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+	case d < 365*24*time.Hour:
+		return fmt.Sprintf("%dmo ago", int(d/(30*24*time.Hour)))
+	}
+
+	return fmt.Sprintf("%dy ago", int(d/(365*24*time.Hour)))
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestRenderName(t *testing.T) {
+	tests := []struct {
+		name      string
+		positions []int
+		room      int
+		drawn     string
+		n         int
+	}{
+		{"ls -la", nil, 10, "ls -la", 6},
+		{"ls -la", []int{0, 4}, 10, highlight + "l" + reset + "s -" + highlight + "l" + reset + "a", 6},
+		{"cat <<EOF\n\x1b[2J\nEOF", nil, 40, "cat <<EOF↵·[2J↵EOF", 18},
+		{"printf 'a\tb'", nil, 20, "printf 'a→b'", 12},
+		{"héllo wörld", []int{10}, 8, "héllo wö", 8},
+		{"日本語 grep", []int{4}, 20, "日本語 " + highlight + "g" + reset + "rep", 8},
+	}
+
+	for _, test := range tests {
+		drawn, n := renderName(test.name, test.positions, test.room, "")
+		if drawn != test.drawn || n != test.n {
+			t.Errorf("renderName(%q) = %q, %d, want %q, %d", test.name, drawn, n, test.drawn, test.n)
+		}
+	}
+}
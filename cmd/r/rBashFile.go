@@ -4,39 +4,95 @@ const rBashFile = `#!/bin/bash
 
 # This will run before any command is executed.
 pre() {
-  if [ -z "$R_AT_PROMPT" ]; then
+  # post itself runs from PROMPT_COMMAND after an empty command line
+  if [ -z "$R_AT_PROMPT" ] || [ "$1" = "post" ]; then
     return
   fi
   unset R_AT_PROMPT
 
   # Keep reference to what command was executed
-  R_LAST_CMD="${1##*/}"
+  R_LAST_CMD="${1%%[[:space:]]*}"
+  R_LAST_CMD="${R_LAST_CMD##*/}"
+  R_START=$SECONDS
   export R_PWD
   R_PWD=$(pwd)
-  CMD=$*
+  CMD=$1
 
 }
 
+# Identify this shell session to r
+export R_SESSION
+R_SESSION="$(tty 2>/dev/null)#$$"
+
+# r pause and r resume only toggle R_PAUSED in this shell so the pause
+# ends with it
+r() {
+  case $1 in
+    pause) export R_PAUSED=1 ;;
+    resume) unset R_PAUSED ;;
+  esac
+  command r "$@"
+}
+
 # Set trap to reun pre before command
-trap 'pre $BASH_COMMAND' DEBUG
+trap 'pre "$BASH_COMMAND"' DEBUG
+
+# Add the command line $1 ran in $2 with exit status $3 taking $4 to r.
+# The command is sent on stdin so it can have any character. Aliases,
+# functions and builtins are passed since they aren't in $PATH
+_r_add() {
+  if [ -n "$R_PAUSED" ]; then
+    return
+  fi
+
+  printf '%s' "$1" | R_SHELL_COMMANDS="$(compgen -abk -A function)" r --cwd "$2" \
+    --exit "$3" --duration "$4" --session "$R_SESSION" --add -
+}
 
 # This will run after the execution of the previous full command line.  We don't
 # want post to execute when first starting a bash session (FIRST_PROMPT)
 R_FIRST_PROMPT=1
 post() {
+  # Keep the exit status before running anything else
+  local last_code=$?
+
+  # pre didn't run so no command was entered
+  local ran=1
+  if [ -n "$R_AT_PROMPT" ]; then
+    ran=
+  fi
   R_AT_PROMPT=1
 
-  if [ -n "$R_FIRST_PROMPT" ]; then
+  # The command line as typed, with its quotes, lists and pipelines, is
+  # taken from the history. $BASH_COMMAND is only the first command of it
+  local cmd=$CMD
+  local hist hist_num
+  hist=$(HISTTIMEFORMAT= history 1)
+  read -r hist_num _ <<< "$hist"
+  hist=${hist#*[0-9]  }
+  if [ -n "$hist_num" ]; then
+    if [ "$hist_num" != "$R_HIST_NUM" ] || [[ $hist == "$CMD"* ]]; then
+      # A new line or the same line again with HISTCONTROL=ignoredups
+      cmd=$hist
+    else
+      case $HISTCONTROL in
+        *ignorespace*|*ignoreboth*)
+          # bash keeps a command line starting with a space out of its
+          # history. Pass the space on so r ignores it too
+          cmd=" $CMD"
+          ;;
+      esac
+    fi
+  fi
+  R_HIST_NUM=$hist_num
+
+  if [ -n "$R_FIRST_PROMPT" ] || [ -z "$ran" ]; then
     unset R_FIRST_PROMPT
     return
   fi
 
-  local last_code=$?
-  # Don't add if the status errored
-  if [ "$last_code" -eq 0 ]; then
-    # Add current directory and command to r
-    r --add "$R_PWD^_$CMD"
-  fi
+  # Add current directory, command and exit status to r
+  _r_add "$cmd" "$R_PWD" "$last_code" "$((SECONDS - R_START))s"
 
   # Test if LAST_CMD was r then run any command selected
   if [ "$R_LAST_CMD" = "r" ]; then
@@ -46,11 +102,13 @@ post() {
       return
     fi
 
-    # execute command
-    eval $last_r_cmd
+    # execute command then add it to r as it ran
+    local dir=$PWD start=$SECONDS
+    eval "$last_r_cmd"
+    _r_add "$last_r_cmd" "$dir" "$?" "$((SECONDS - start))s"
 
     # save command to bash history
-    history -s $last_r_cmd
+    history -s "$last_r_cmd"
 
     return
   fi
@@ -0,0 +1,70 @@
+package main
+
+const rFishFile = `# r integration for fish. Installed by r -install into conf.d
+# so fish loads it on startup
+
+# Identify this shell session to r
+set -gx R_SESSION (tty 2>/dev/null)"#"$fish_pid
+
+# r pause and r resume only toggle R_PAUSED in this shell so the pause
+# ends with it
+function r
+  switch "$argv[1]"
+    case pause
+      set -gx R_PAUSED 1
+    case resume
+      set -e R_PAUSED
+  end
+  command r $argv
+end
+
+# This will run before any command is executed
+function __r_preexec --on-event fish_preexec
+  set -g R_PWD $PWD
+end
+
+# Add the command line $argv[1] ran in $argv[2] with exit status
+# $argv[3] taking $argv[4] to r. The command is sent on stdin so it can
+# have any character. Functions, builtins and abbreviations are passed
+# since they aren't in $PATH
+function __r_add
+  if test -n "$R_PAUSED"
+    return
+  end
+
+  set -lx R_SHELL_COMMANDS (functions -a) (builtin -n) (abbr --list 2>/dev/null)
+  printf '%s' $argv[1] | r --cwd "$argv[2]" --exit "$argv[3]" --duration "$argv[4]" \
+    --session "$R_SESSION" --add -
+end
+
+# This will run after the execution of the previous full command line.
+# fish passes the command line as typed in $argv. A leading space keeps it
+# out of fish's history and is passed on so r ignores it too
+function __r_postexec --on-event fish_postexec
+  set -l last_code $status
+  set -l cmd $argv[1]
+
+  # Add current directory, command and exit status to r
+  __r_add "$cmd" "$R_PWD" $last_code "$CMD_DURATION"ms
+
+  # Keep reference to what command was executed
+  set -l last_cmd (string split -m 1 ' ' -- (string trim -- $cmd))[1]
+  set last_cmd (string replace -r '.*/' '' -- $last_cmd)
+
+  # Test if last command was r then run any command selected
+  if test "$last_cmd" = r
+    set -l last_r_cmd (r --command)
+    if test -z "$last_r_cmd"
+      return
+    end
+
+    # execute command then add it to r as it ran. Multiline commands
+    # are split in lines by fish
+    set -l dir $PWD
+    set -l start (date +%s)
+    printf '%s\n' $last_r_cmd | source
+    set -l code $status
+    __r_add (string join \n -- $last_r_cmd | string collect) $dir $code (math (date +%s) - $start)s
+  end
+end
+`
@@ -0,0 +1,85 @@
+package main
+
+const rZshFile = `#!/bin/zsh
+
+zmodload zsh/datetime
+
+# Identify this shell session to r
+export R_SESSION="$(tty 2>/dev/null)#$$"
+
+# r pause and r resume only toggle R_PAUSED in this shell so the pause
+# ends with it. This also replaces zsh's r builtin
+r() {
+  case $1 in
+    pause) export R_PAUSED=1 ;;
+    resume) unset R_PAUSED ;;
+  esac
+  command r "$@"
+}
+
+# This will run before any command is executed. zsh passes the full
+# command line as typed in $1. A leading space is passed on so r ignores
+# it like HIST_IGNORE_SPACE
+_r_preexec() {
+  # Keep reference to what command was executed
+  R_LAST_CMD="${${(z)1}[1]##*/}"
+  R_PWD=$PWD
+  R_CMD=$1
+  R_START=$EPOCHREALTIME
+}
+
+# Add the command line $1 ran in $2 with exit status $3 taking $4 to r.
+# The command is sent on stdin so it can have any character. Aliases,
+# functions and builtins are passed since they aren't in $PATH
+_r_add() {
+  if [ -n "$R_PAUSED" ]; then
+    return
+  fi
+
+  print -rn -- "$1" | R_SHELL_COMMANDS="${(k)aliases} ${(k)functions} ${(k)builtins} ${(k)reswords}" \
+    r --cwd "$2" --exit "$3" --duration "$4" --session "$R_SESSION" --add -
+}
+
+# This will run after the execution of the previous full command line
+# and before the prompt is drawn. precmd doesn't run for an empty command
+# line since preexec is never called so R_CMD will be unset
+_r_precmd() {
+  local last_code=$?
+
+  if [ -z "$R_CMD" ]; then
+    return
+  fi
+
+  local cmd=$R_CMD
+  local -i duration=$(( (EPOCHREALTIME - R_START) * 1000 ))
+  unset R_CMD
+
+  # Add current directory, command and exit status to r
+  _r_add "$cmd" "$R_PWD" "$last_code" "${duration}ms"
+
+  # Test if LAST_CMD was r then run any command selected
+  if [ "$R_LAST_CMD" = "r" ]; then
+    local last_r_cmd
+    last_r_cmd=$(r --command)
+    if [ -z "$last_r_cmd" ]; then
+      return
+    fi
+
+    # save command to zsh history
+    print -s -- "$last_r_cmd"
+
+    # execute command then add it to r as it ran
+    local dir=$PWD start=$EPOCHREALTIME
+    eval "$last_r_cmd"
+    last_code=$?
+    duration=$(( (EPOCHREALTIME - start) * 1000 ))
+    _r_add "$last_r_cmd" "$dir" "$last_code" "${duration}ms"
+
+    return
+  fi
+}
+
+autoload -Uz add-zsh-hook
+add-zsh-hook preexec _r_preexec
+add-zsh-hook precmd _r_precmd
+`
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesselucas/r"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// syncCommand exchanges history with r on another machine over SSH:
+// `r sync [-i key] [-command r] user@host[:port]`. It runs
+// `r sync --server` on the other machine, which syncs over stdin and stdout
+func syncCommand(s *r.Session, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	serverPtr := flags.Bool("server", false, "sync over stdin and stdout, ran on the other machine by r sync")
+	identityPtr := flags.String("i", "", "private key file to authenticate with instead of ~/.ssh/id_ecdsa and ~/.ssh/id_rsa")
+	commandPtr := flags.String("command", "r", "path of r on the other machine")
+	flags.Parse(args)
+
+	if *serverPtr {
+		// stdout carries the sync so errors go to stderr
+		_, _, err := s.Sync(stdio{})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: r sync [-i key] [-command r] user@host[:port]")
+	}
+
+	login, addr, err := sshTarget(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	auth, closeAuth, err := sshAuth(*identityPtr)
+	if err != nil {
+		return err
+	}
+	defer closeAuth()
+
+	homeDir, err := homeDirectory()
+	if err != nil {
+		return err
+	}
+
+	hostKeys, err := knownHosts(filepath.Join(homeDir, ".ssh", "known_hosts"))
+	if err != nil {
+		return err
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            login,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sent, received, err := syncSSH(s, client, *commandPtr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Sent %d and received %d changes from %s.\n", sent, received, flags.Arg(0))
+	return nil
+}
+
+// stdio reads stdin and writes stdout
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdio) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+// syncSSH runs `<command> sync --server` on the other end of client and
+// syncs with it. What the command writes to stderr is added to errors
+func syncSSH(s *r.Session, client *ssh.Client, command string) (int, int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	err = session.Start(command + " sync --server")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sent, received, err := s.Sync(struct {
+		io.Reader
+		io.Writer
+	}{stdout, stdin})
+	stdin.Close()
+
+	waitErr := session.Wait()
+	if err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", err, msg)
+		}
+		return 0, 0, err
+	}
+
+	return sent, received, nil
+}
+
+// sshTarget splits user@host[:port] into the user, the current user
+// when it's left out, and the address to dial, on port 22 by default
+func sshTarget(target string) (string, string, error) {
+	login := ""
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		login, target = target[:i], target[i+1:]
+	}
+
+	if login == "" {
+		usr, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+		login = usr.Username
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(strings.Trim(target, "[]"), "22")
+	}
+
+	if host, _, _ := net.SplitHostPort(target); host == "" {
+		return "", "", fmt.Errorf("missing host in %q", target)
+	}
+
+	return login, target, nil
+}
+
+// sshAuth returns the keys of the running ssh-agent and the private key
+// file identity or, without one, the default key files that can be read.
+// The returned function closes the connection to the agent
+func sshAuth(identity string) ([]ssh.AuthMethod, func(), error) {
+	var auth []ssh.AuthMethod
+	closeAuth := func() {}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closeAuth = func() { conn.Close() }
+		}
+	}
+
+	var signers []ssh.Signer
+	if identity != "" {
+		signer, err := readSigner(identity)
+		if err != nil {
+			closeAuth()
+			return nil, nil, fmt.Errorf("%s: %s", identity, err)
+		}
+		signers = append(signers, signer)
+	} else {
+		homeDir, err := homeDirectory()
+		if err != nil {
+			closeAuth()
+			return nil, nil, err
+		}
+
+		// Keys that are encrypted or in a format ssh can't read are left to the agent
+		for _, name := range []string{"id_ecdsa", "id_rsa"} {
+			signer, err := readSigner(filepath.Join(homeDir, ".ssh", name))
+			if err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if len(auth) == 0 {
+		closeAuth()
+		return nil, nil, errors.New("no SSH key found. Start ssh-agent or pass a key with -i")
+	}
+
+	return auth, closeAuth, nil
+}
+
+// readSigner reads an unencrypted PEM private key
+func readSigner(path string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(pem)
+}
+
+// knownHost is an entry of a known_hosts file
+type knownHost struct {
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// knownHosts returns a callback accepting only the host keys listed in
+// the OpenSSH known_hosts file at path, hashed host names included
+func knownHosts(path string) (func(hostname string, remote net.Addr, key ssh.PublicKey) error, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var hosts []knownHost
+	for len(data) > 0 {
+		marker, patterns, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		hosts = append(hosts, knownHost{marker, patterns, key})
+		data = rest
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		host := knownHostsName(hostname)
+
+		accepted := false
+		mismatch := false
+		for _, known := range hosts {
+			if !matchHost(known.patterns, host) {
+				continue
+			}
+
+			same := bytes.Equal(known.key.Marshal(), key.Marshal())
+			switch {
+			case known.marker == "revoked" && same:
+				return fmt.Errorf("host key of %s is revoked in %s", host, path)
+			case known.marker != "":
+				continue
+			case same:
+				accepted = true
+			case known.key.Type() == key.Type():
+				mismatch = true
+			}
+		}
+
+		switch {
+		case accepted:
+			return nil
+		case mismatch:
+			return fmt.Errorf("host key of %s doesn't match %s. It changed or someone is intercepting the connection", host, path)
+		}
+		return fmt.Errorf("%s isn't in %s. Connect with ssh once to add its host key", host, path)
+	}, nil
+}
+
+// knownHostsName returns how known_hosts names the host at addr.
+// Hosts on a port other than 22 are written [host]:port
+func knownHostsName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// matchHost checks if the host patterns of a known_hosts entry match
+// host. Patterns can be hashed, use * and ? wildcards or be negated by !
+func matchHost(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "|1|") {
+			if matchHashedHost(pattern, host) {
+				matched = true
+			}
+			continue
+		}
+
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		// Brackets around hosts with a port aren't character classes
+		pattern = strings.NewReplacer("[", `\[`, "]", `\]`).Replace(pattern)
+		if ok, _ := path.Match(pattern, host); !ok {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// matchHashedHost checks a "|1|<salt>|<hash>" pattern, the base64
+// HMAC-SHA1 of the host name keyed with the salt
+func matchHashedHost(pattern string, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
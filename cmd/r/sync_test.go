@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jesselucas/r"
+	"golang.org/x/crypto/ssh"
+)
+
+// newSigner generates an ECDSA key
+func newSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// serveSync runs an SSH server on l answering `r sync --server` with
+// remote. Only clientKey can log in
+func serveSync(l net.Listener, remote *r.Session, hostKey ssh.Signer, clientKey ssh.PublicKey) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+					continue
+				}
+
+				ch, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+
+				for req := range requests {
+					var exec struct{ Command string }
+					if req.Type != "exec" || ssh.Unmarshal(req.Payload, &exec) != nil || exec.Command != "r sync --server" {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+
+					status := struct{ Status uint32 }{0}
+					_, _, err := remote.Sync(ch)
+					if err != nil {
+						ch.Stderr().Write([]byte(err.Error()))
+						status.Status = 1
+					}
+
+					ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSyncSSH(t *testing.T) {
+	local := new(r.Session)
+	local.Store = r.NewMemoryStore()
+	remote := new(r.Session)
+	remote.Store = r.NewMemoryStore()
+
+	start := time.Now().Add(-time.Hour)
+	for i, s := range []*r.Session{local, remote, remote} {
+		err := s.AddRun("ls -a", &r.Run{Dir: "/tmp", Start: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hostKey := newSigner(t)
+	clientKey := newSigner(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveSync(l, remote, hostKey, clientKey.PublicKey())
+
+	dir, err := ioutil.TempDir("", "r-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostsPath := filepath.Join(dir, "known_hosts")
+	writeKnownHost := func(host string, key ssh.PublicKey) {
+		err := ioutil.WriteFile(hostsPath, []byte(host+" "+string(ssh.MarshalAuthorizedKey(key))), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dial := func() (*ssh.Client, error) {
+		hostKeys, err := knownHosts(hostsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User:            "me",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+			HostKeyCallback: hostKeys,
+		})
+	}
+
+	writeKnownHost(knownHostsName(l.Addr().String()), newSigner(t).PublicKey())
+	if _, err := dial(); err == nil {
+		t.Fatal("a host key that isn't in known_hosts should be refused")
+	}
+
+	// List the host key under a hashed host name
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(knownHostsName(l.Addr().String())))
+	hashed := "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	writeKnownHost(hashed, hostKey.PublicKey())
+
+	client, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	count := func(s *r.Session) int {
+		results, err := s.ResultsDirectory("/tmp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 {
+			t.Fatal("sync should keep the directory history, got", len(results))
+		}
+		return results[0].Info.Count
+	}
+
+	_, received, err := syncSSH(local, client, "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received == 0 || count(local) != 3 || count(remote) != 3 {
+		t.Errorf("uses on both ends should add up to 3, got %d and %d", count(local), count(remote))
+	}
+
+	_, received, err = syncSSH(local, client, "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != 0 || count(local) != 3 || count(remote) != 3 {
+		t.Errorf("syncing again should change nothing, received %d", received)
+	}
+
+	if _, _, err := syncSSH(local, client, "/usr/local/bin/r"); err == nil {
+		t.Error("a command the server refuses should fail")
+	}
+}
+
+func TestSSHTarget(t *testing.T) {
+	for _, test := range []struct {
+		target, login, addr string
+	}{
+		{"me@example.com", "me", "example.com:22"},
+		{"me@example.com:2222", "me", "example.com:2222"},
+		{"me@[::1]", "me", "[::1]:22"},
+	} {
+		login, addr, err := sshTarget(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login != test.login || addr != test.addr {
+			t.Errorf("%s: got %s and %s", test.target, login, addr)
+		}
+	}
+
+	if _, _, err := sshTarget("me@"); err == nil {
+		t.Error("a target without a host should fail")
+	}
+}
@@ -10,6 +10,26 @@ import (
 	"strings"
 )
 
+// shell describes how r hooks into an interactive shell
+type shell struct {
+	name       string                 // Name of the shell
+	sourceName string                 // File name of the hook script in the home directory
+	script     string                 // Contents of the hook script
+	rcPath     func() (string, error) // Finds the startup file that sources the hook script
+
+	// autoload is set for shells that load every script in the conf.d
+	// directory next to their startup file. The hook script is written
+	// there instead of being sourced from the startup file
+	autoload bool
+}
+
+// shells r knows how to install into
+var shells = []*shell{
+	{name: "bash", sourceName: rSourceName, script: rBashFile, rcPath: bashPath},
+	{name: "zsh", sourceName: rZshSourceName, script: rZshFile, rcPath: zshPath},
+	{name: "fish", sourceName: rFishSourceName, script: rFishFile, rcPath: fishPath, autoload: true},
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	if err != nil {
@@ -66,46 +86,149 @@ func checkFileForString(path string, s string) bool {
 	return false
 }
 
-func installed() bool {
-	// Check if there is a .bashrc
-	path, err := bashPath()
+func zshPath() (string, error) {
+	homeDir, err := homeDirectory()
 	if err != nil {
-		return false // Doesn't have bash_profile or bashrc
+		return "", err
 	}
 
-	if checkFileForString(path, rSourceName) {
-		return true
+	// zsh reads its startup files from $ZDOTDIR when it is set
+	dir := os.Getenv("ZDOTDIR")
+	if dir == "" {
+		dir = homeDir
 	}
 
-	return false
+	// Check if there is a .zshrc
+	zshrc := filepath.Join(dir, ".zshrc")
+	if fileExists(zshrc) {
+		return zshrc, nil
+	}
+
+	// zsh is the login shell but a .zshrc hasn't been created yet
+	if filepath.Base(os.Getenv("SHELL")) == "zsh" {
+		return zshrc, nil
+	}
+
+	return "", errors.New("Couldn't find .zshrc")
+}
+
+func fishPath() (string, error) {
+	homeDir, err := homeDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	// fish follows the XDG base directory spec
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(homeDir, ".config")
+	}
+
+	// Check if there is a config.fish
+	config := filepath.Join(dir, "fish", "config.fish")
+	if fileExists(config) {
+		return config, nil
+	}
+
+	return "", errors.New("Couldn't find config.fish")
 }
 
-func sourceR(path string) error {
-	// Get home directory
+// hookPath returns where the hook script is written for the
+// startup file found at path
+func (sh *shell) hookPath(path string) (string, error) {
+	if sh.autoload {
+		return filepath.Join(filepath.Dir(path), "conf.d", sh.sourceName), nil
+	}
+
 	homeDir, err := homeDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, sh.sourceName), nil
+}
+
+func (sh *shell) installed(path string) bool {
+	if sh.autoload {
+		hook, err := sh.hookPath(path)
+		if err != nil {
+			return false
+		}
+		return fileExists(hook)
+	}
+
+	return checkFileForString(path, sh.sourceName)
+}
+
+func (sh *shell) source(path string) error {
+	hook, err := sh.hookPath(path)
 	if err != nil {
 		return err
 	}
 
-	// Create .r.sh file in homeDirectory
-	f, err := os.Create(filepath.Join(homeDir, rSourceName))
+	// Create hook file
+	err = os.MkdirAll(filepath.Dir(hook), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(hook)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	f.WriteString(rBashFile)
+	f.WriteString(sh.script)
+
+	// The shell loads the hook file itself
+	if sh.autoload {
+		return nil
+	}
 
-	// Source .r.sh in bashrc
-	bashFile, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	// Source hook file in the shell's rc file
+	rcFile, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
-	defer bashFile.Close()
+	defer rcFile.Close()
 
-	rSourceFile := fmt.Sprintf("\n# r sourced from r -install \n. %s/%s", homeDir, rSourceName)
-	if _, err = bashFile.WriteString(rSourceFile); err != nil {
+	rSourceFile := fmt.Sprintf("\n# r sourced from r -install \n. %s", hook)
+	if _, err = rcFile.WriteString(rSourceFile); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// historyPath returns the default history file of the shell
+func historyPath(name string) (string, error) {
+	homeDir, err := homeDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	switch name {
+	case "bash":
+		if path := os.Getenv("HISTFILE"); path != "" {
+			return path, nil
+		}
+		return filepath.Join(homeDir, ".bash_history"), nil
+	case "zsh":
+		if path := os.Getenv("HISTFILE"); path != "" {
+			return path, nil
+		}
+
+		dir := os.Getenv("ZDOTDIR")
+		if dir == "" {
+			dir = homeDir
+		}
+		return filepath.Join(dir, ".zsh_history"), nil
+	case "fish":
+		dir := os.Getenv("XDG_DATA_HOME")
+		if dir == "" {
+			dir = filepath.Join(homeDir, ".local", "share")
+		}
+		return filepath.Join(dir, "fish", "fish_history"), nil
+	}
+
+	return "", fmt.Errorf("unknown shell %q. Use bash, zsh or fish", name)
+}
@@ -12,30 +12,30 @@ import (
 type Command struct {
 	Name string
 	Info *CommandInfo
+	// Frecency is set from the run log when sorting by frecency
+	Frecency float64
+	// Dir is the directory the command was found in. It's empty
+	// for commands from the global history
+	Dir string
+	// Distance is how many directories Dir is from the current directory
+	Distance int
 }
 
 // CommandInfo struct is stored as the value to commands
 type CommandInfo struct {
 	Time  time.Time
 	Count int
+	Exit  int // Exit status of the last run
 }
 
 func (ci *CommandInfo) String() string {
 	// Store the time in RFC3339 format for easy parsing
-	return fmt.Sprintf("%s%s%d", ci.Time.Format(time.RFC3339), ",", ci.Count)
+	return fmt.Sprintf("%s,%d,%d", ci.Time.Format(time.RFC3339), ci.Count, ci.Exit)
 }
 
-// Update method will update the time and count of CommandInfo
-func (ci *CommandInfo) Update(ciString string) {
-	info := strings.Split(ciString, ",")
-
-	count, err := strconv.Atoi(info[1])
-	if err != nil {
-		count = 0
-	}
-
-	ci.Time = time.Now()
-	ci.Count = count + 1
+// Failed checks if the last run of the command exited with an error
+func (ci *CommandInfo) Failed() bool {
+	return ci.Exit != 0
 }
 
 // NewFromString creates a new CommandInfo struct from a string
@@ -48,13 +48,27 @@ func (ci *CommandInfo) NewFromString(ciString string) *CommandInfo {
 		date = time.Now()
 	}
 
-	count, err := strconv.Atoi(info[1])
-	if err != nil {
-		count = 0
+	// Values without a count are treated as never used
+	count := 0
+	if len(info) > 1 {
+		count, err = strconv.Atoi(info[1])
+		if err != nil {
+			count = 0
+		}
+	}
+
+	// Values stored before exit statuses were recorded only had successes
+	exit := 0
+	if len(info) > 2 {
+		exit, err = strconv.Atoi(info[2])
+		if err != nil {
+			exit = 0
+		}
 	}
 
 	ci.Time = date
 	ci.Count = count
+	ci.Exit = exit
 
 	return ci
 }
@@ -94,3 +108,21 @@ func (s byUsage) Less(i, j int) bool {
 func (s byUsage) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
+
+// byFrecency sorts by frecency
+type byFrecency []*Command
+
+// Len used for sorting
+func (s byFrecency) Len() int {
+	return len(s)
+}
+
+// Less used for sorting
+func (s byFrecency) Less(i, j int) bool {
+	return s[i].Frecency > s[j].Frecency
+}
+
+// Swap used for sorting
+func (s byFrecency) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,480 @@
+package r
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Errors of command lines the shell would ask to continue
+var (
+	ErrUnterminatedQuote   = errors.New("unterminated quote")
+	ErrUnterminatedHeredoc = errors.New("unterminated heredoc")
+)
+
+// CommandLine is a shell command line split into its commands
+type CommandLine struct {
+	Commands []*SimpleCommand
+}
+
+// SimpleCommand is a command of a pipeline or a list
+type SimpleCommand struct {
+	Assignments []*Word // Variable assignments before the command, ex. VAR=1
+	Words       []*Word // The command and its arguments
+	Redirects   []*Word // Redirections and their targets, ex. 2>&1 or >out
+	// Operator follows the command: |, |&, &&, ||, ; or &. It's empty for
+	// the last command
+	Operator string
+	// Start and End are the byte offsets of the command in the line
+	Start, End int
+}
+
+// Word is a word of a command line
+type Word struct {
+	Text string // The word with its quotes and escapes removed
+	// Start and End are the byte offsets of the word in the line
+	Start, End int
+}
+
+// reservedWords start a command without running anything
+var reservedWords = map[string]bool{
+	"!": true, "{": true, "}": true, "if": true, "then": true, "elif": true,
+	"else": true, "while": true, "until": true, "do": true,
+}
+
+// redirection matches a redirection operator starting a word, ex. 2>>
+var redirection = regexp.MustCompile(`^([0-9]+|&)?(<<<|<<-|<<|<>|<&|>>|>&|>\||<|>)`)
+
+// Args returns the text of the command's words
+func (c *SimpleCommand) Args() []string {
+	var args []string
+	for _, w := range c.Words {
+		args = append(args, w.Text)
+	}
+	return args
+}
+
+// Program returns the word of the program the command runs. Reserved
+// words and wrappers like sudo, time or nohup before it are skipped. It
+// returns nil when the command doesn't run a program
+func (c *SimpleCommand) Program() *Word {
+	var wrapper *Word
+	for i := 0; i < len(c.Words); i++ {
+		w := c.Words[i]
+		if reservedWords[w.Text] || (wrapper != nil && assignment.MatchString(w.Text)) {
+			continue
+		}
+
+		options, ok := shellWrappers[w.Text]
+		if !ok {
+			return w
+		}
+
+		// Skip the options of the wrapper and their arguments
+		wrapper = w
+		for i+1 < len(c.Words) && strings.HasPrefix(c.Words[i+1].Text, "-") {
+			i++
+			if c.Words[i].Text == "--" {
+				break
+			}
+
+			option := c.Words[i].Text
+			if len(option) == 2 && strings.Contains(options, option[1:]) {
+				i++
+			}
+		}
+	}
+
+	return wrapper
+}
+
+// heredoc is a here-document waiting for the end of the line
+type heredoc struct {
+	delimiter string
+	tabs      bool // <<- strips leading tabs
+}
+
+// lineParser holds the state of ParseCommandLine
+type lineParser struct {
+	line     string
+	i        int
+	commands []*SimpleCommand
+	current  *SimpleCommand
+	heredocs []heredoc
+	// redirect is set when the next word is the target of a redirection
+	redirect *Word
+}
+
+// ParseCommandLine splits line into its commands and their words the
+// way a POSIX shell does. Quotes and escapes are removed from the words
+// but command substitutions and expansions are kept as they are.
+// Subshells and groups are flattened and here-documents are skipped
+func ParseCommandLine(line string) (*CommandLine, error) {
+	p := &lineParser{line: line}
+
+	for p.i < len(p.line) {
+		c := p.line[p.i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			p.i++
+		case c == '\\' && p.i+1 < len(p.line) && p.line[p.i+1] == '\n':
+			// Line continuation
+			p.i += 2
+		case c == '\n':
+			p.i++
+			p.operator(";")
+			err := p.readHeredocs()
+			if err != nil {
+				return nil, err
+			}
+		case c == '#':
+			// Comments run to the end of the line
+			for p.i < len(p.line) && p.line[p.i] != '\n' {
+				p.i++
+			}
+		case c == '(' || c == ')':
+			// Subshells run the commands inside them
+			p.i++
+			p.operator("")
+		case c == '&' && p.peek(1) == '>':
+			err := p.word()
+			if err != nil {
+				return nil, err
+			}
+		case c == '|' || c == '&' || c == ';':
+			op := string(c)
+			if next := p.peek(1); (next == c && c != ';') || (c == '|' && next == '&') {
+				op += string(next)
+			}
+			p.i += len(op)
+			p.operator(op)
+		default:
+			err := p.word()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(p.heredocs) > 0 {
+		return nil, ErrUnterminatedHeredoc
+	}
+
+	p.operator("")
+	if n := len(p.commands); n > 0 {
+		p.commands[n-1].Operator = ""
+	}
+
+	return &CommandLine{Commands: p.commands}, nil
+}
+
+// peek returns the byte n bytes after the current one or 0 past the end
+func (p *lineParser) peek(n int) byte {
+	if p.i+n < len(p.line) {
+		return p.line[p.i+n]
+	}
+	return 0
+}
+
+// operator ends the current command. Operators after a subshell belong
+// to the command before it
+func (p *lineParser) operator(op string) {
+	p.redirect = nil
+
+	if p.current == nil {
+		if n := len(p.commands); n > 0 && p.commands[n-1].Operator == "" {
+			p.commands[n-1].Operator = op
+		}
+		return
+	}
+
+	p.current.Operator = op
+	p.commands = append(p.commands, p.current)
+	p.current = nil
+}
+
+// word reads the word at the current byte and adds it to the current
+// command
+func (p *lineParser) word() error {
+	start := p.i
+	var b strings.Builder
+
+	for p.i < len(p.line) {
+		c := p.line[p.i]
+
+		switch {
+		case c == '(' && strings.HasSuffix(p.line[start:p.i], "=") && assignment.MatchString(p.line[start:p.i]):
+			// Array assignments, ex. arr=(a b)
+			err := p.array(&b)
+			if err != nil {
+				return err
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == ';' || c == '(' || c == ')':
+			return p.addWord(&Word{Text: b.String(), Start: start, End: p.i})
+		case (c == '|' || c == '&' || c == '<' || c == '>') && p.endsWord(start):
+			return p.addWord(&Word{Text: b.String(), Start: start, End: p.i})
+		case c == '\\' && p.i+1 == len(p.line):
+			// A backslash ending the line is kept as it is
+			b.WriteByte(c)
+			p.i++
+		case c == '\\':
+			if p.line[p.i+1] != '\n' {
+				b.WriteByte(p.line[p.i+1])
+			}
+			p.i += 2
+		case c == '\'':
+			end := strings.IndexByte(p.line[p.i+1:], '\'')
+			if end < 0 {
+				return ErrUnterminatedQuote
+			}
+			b.WriteString(p.line[p.i+1 : p.i+1+end])
+			p.i += end + 2
+		case c == '"':
+			err := p.doubleQuoted(&b)
+			if err != nil {
+				return err
+			}
+		case c == '$' && p.peek(1) == '\'':
+			p.i++
+			err := p.ansiQuoted(&b)
+			if err != nil {
+				return err
+			}
+		case c == '$' && p.peek(1) == '"':
+			p.i++
+		case c == '$' && (p.peek(1) == '(' || p.peek(1) == '{'), c == '`':
+			err := p.substitution(&b)
+			if err != nil {
+				return err
+			}
+		default:
+			b.WriteByte(c)
+			p.i++
+		}
+	}
+
+	return p.addWord(&Word{Text: b.String(), Start: start, End: p.i})
+}
+
+// endsWord checks if the operator at the current byte ends the word
+// starting at start. Operators are part of a redirection starting the
+// word, ex. 2>&1, &>out or >|out
+func (p *lineParser) endsWord(start int) bool {
+	op := redirection.FindString(p.line[start:])
+	if op != "" && p.i < start+len(op) {
+		return false
+	}
+
+	// File descriptors before a redirection, ex. 2>
+	c := p.line[p.i]
+	return !((c == '<' || c == '>') && strings.Trim(p.line[start:p.i], "0123456789") == "")
+}
+
+// array copies the parentheses of an array assignment as they are
+func (p *lineParser) array(b *strings.Builder) error {
+	end := strings.IndexByte(p.line[p.i:], ')')
+	if end < 0 {
+		return ErrUnterminatedQuote
+	}
+
+	b.WriteString(p.line[p.i : p.i+end+1])
+	p.i += end + 1
+	return nil
+}
+
+// addWord adds w to the current command as an assignment, a redirection,
+// the target of a redirection or a word
+func (p *lineParser) addWord(w *Word) error {
+	if p.current == nil {
+		p.current = &SimpleCommand{Start: w.Start}
+	}
+	cmd := p.current
+	cmd.End = w.End
+
+	raw := p.line[w.Start:w.End]
+	switch {
+	case p.redirect != nil:
+		// The target of the redirection before
+		p.redirect.Text += w.Text
+		p.redirect.End = w.End
+		p.redirect = nil
+		p.heredocDelimiter(w.Text)
+	case redirection.MatchString(raw):
+		op := redirection.FindString(raw)
+		cmd.Redirects = append(cmd.Redirects, w)
+		if strings.Contains(op, "<<") && !strings.Contains(op, "<<<") {
+			p.heredocs = append(p.heredocs, heredoc{tabs: strings.HasSuffix(op, "-")})
+		}
+
+		if raw == op {
+			p.redirect = w
+		} else {
+			p.heredocDelimiter(w.Text[len(op):])
+		}
+	case len(cmd.Words) == 0 && assignment.MatchString(raw):
+		cmd.Assignments = append(cmd.Assignments, w)
+	default:
+		cmd.Words = append(cmd.Words, w)
+	}
+
+	return nil
+}
+
+// heredocDelimiter sets the delimiter of the last here-document when it
+// doesn't have one yet
+func (p *lineParser) heredocDelimiter(delimiter string) {
+	if n := len(p.heredocs); n > 0 && p.heredocs[n-1].delimiter == "" {
+		p.heredocs[n-1].delimiter = delimiter
+	}
+}
+
+// readHeredocs skips the bodies of the here-documents of the line that
+// just ended
+func (p *lineParser) readHeredocs() error {
+	for _, h := range p.heredocs {
+		for {
+			if p.i >= len(p.line) {
+				return ErrUnterminatedHeredoc
+			}
+
+			end := strings.IndexByte(p.line[p.i:], '\n')
+			if end < 0 {
+				end = len(p.line) - p.i
+			}
+			body := p.line[p.i : p.i+end]
+			p.i += end + 1
+
+			if h.tabs {
+				body = strings.TrimLeft(body, "\t")
+			}
+			if body == h.delimiter {
+				break
+			}
+		}
+	}
+
+	p.heredocs = nil
+	return nil
+}
+
+// doubleQuoted reads a double quoted string. Backslashes only escape
+// $, `, ", \ and newlines
+func (p *lineParser) doubleQuoted(b *strings.Builder) error {
+	p.i++
+	for p.i < len(p.line) {
+		c := p.line[p.i]
+
+		switch {
+		case c == '"':
+			p.i++
+			return nil
+		case c == '\\' && strings.IndexByte("$`\"\\\n", p.peek(1)) >= 0 && p.peek(1) != 0:
+			if p.peek(1) != '\n' {
+				b.WriteByte(p.peek(1))
+			}
+			p.i += 2
+		case c == '$' && (p.peek(1) == '(' || p.peek(1) == '{'), c == '`':
+			err := p.substitution(b)
+			if err != nil {
+				return err
+			}
+		default:
+			b.WriteByte(c)
+			p.i++
+		}
+	}
+
+	return ErrUnterminatedQuote
+}
+
+// ansiQuoted reads a $'...' string, replacing its escapes
+func (p *lineParser) ansiQuoted(b *strings.Builder) error {
+	escapes := map[byte]byte{'n': '\n', 't': '\t', 'r': '\r', 'a': '\a', 'b': '\b', 'e': 0x1b, 'f': '\f', 'v': '\v'}
+
+	p.i++
+	for p.i < len(p.line) {
+		c := p.line[p.i]
+
+		switch {
+		case c == '\'':
+			p.i++
+			return nil
+		case c == '\\' && p.i+1 < len(p.line):
+			next := p.line[p.i+1]
+			if e, ok := escapes[next]; ok {
+				b.WriteByte(e)
+			} else {
+				b.WriteByte(next)
+			}
+			p.i += 2
+		default:
+			b.WriteByte(c)
+			p.i++
+		}
+	}
+
+	return ErrUnterminatedQuote
+}
+
+// substitution copies a $(...), ${...} or `...` expansion as it is,
+// including the quotes and expansions nested in it
+func (p *lineParser) substitution(b *strings.Builder) error {
+	start := p.i
+
+	if p.line[p.i] == '`' {
+		p.i++
+		for p.i < len(p.line) && p.line[p.i] != '`' {
+			if p.line[p.i] == '\\' {
+				p.i++
+			}
+			p.i++
+		}
+		if p.i >= len(p.line) {
+			return ErrUnterminatedQuote
+		}
+		p.i++
+		b.WriteString(p.line[start:p.i])
+		return nil
+	}
+
+	open, close := p.line[p.i+1], byte(')')
+	if open == '{' {
+		close = '}'
+	}
+
+	p.i += 2
+	depth := 1
+	for depth > 0 {
+		if p.i >= len(p.line) {
+			return ErrUnterminatedQuote
+		}
+
+		switch c := p.line[p.i]; {
+		case c == '\\':
+			p.i += 2
+		case c == '\'':
+			end := strings.IndexByte(p.line[p.i+1:], '\'')
+			if end < 0 {
+				return ErrUnterminatedQuote
+			}
+			p.i += end + 2
+		case c == '"':
+			err := p.doubleQuoted(new(strings.Builder))
+			if err != nil {
+				return err
+			}
+		case c == open:
+			depth++
+			p.i++
+		case c == close:
+			depth--
+			p.i++
+		default:
+			p.i++
+		}
+	}
+
+	b.WriteString(p.line[start:p.i])
+	return nil
+}
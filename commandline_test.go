@@ -0,0 +1,93 @@
+package r
+
+import (
+	"reflect"
+	"testing"
+)
+
+// parsed is a command of a parsed line in a comparable form
+type parsed struct {
+	assignments, args, redirects []string
+	operator                     string
+}
+
+func parseLine(t *testing.T, line string) []parsed {
+	l, err := ParseCommandLine(line)
+	if err != nil {
+		t.Fatalf("%q: %s", line, err)
+	}
+
+	texts := func(words []*Word) []string {
+		var res []string
+		for _, w := range words {
+			res = append(res, w.Text)
+		}
+		return res
+	}
+
+	var res []parsed
+	for _, c := range l.Commands {
+		res = append(res, parsed{texts(c.Assignments), c.Args(), texts(c.Redirects), c.Operator})
+	}
+	return res
+}
+
+func TestParseCommandLine(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		commands []parsed
+	}{
+		{"  ls -la ", []parsed{{nil, []string{"ls", "-la"}, nil, ""}}},
+		{`echo 'a b' "c \"d\" \$e" f\ g`, []parsed{{nil, []string{"echo", "a b", `c "d" $e`, "f g"}, nil, ""}}},
+		{`echo $'a\tb' $"c"`, []parsed{{nil, []string{"echo", "a\tb", "c"}, nil, ""}}},
+		{`echo foo\`, []parsed{{nil, []string{"echo", `foo\`}, nil, ""}}},
+		{`\`, []parsed{{nil, []string{`\`}, nil, ""}}},
+		{"ls \\\nfoo", []parsed{{nil, []string{"ls", "foo"}, nil, ""}}},
+		{"A=1 B='x y' make test", []parsed{{[]string{"A=1", "B=x y"}, []string{"make", "test"}, nil, ""}}},
+		{"arr=(a b) ls", []parsed{{[]string{"arr=(a b)"}, []string{"ls"}, nil, ""}}},
+		{"make && make test || echo failed; ls &", []parsed{
+			{nil, []string{"make"}, nil, "&&"},
+			{nil, []string{"make", "test"}, nil, "||"},
+			{nil, []string{"echo", "failed"}, nil, ";"},
+			{nil, []string{"ls"}, nil, ""},
+		}},
+		{"git log|grep fix |& less", []parsed{
+			{nil, []string{"git", "log"}, nil, "|"},
+			{nil, []string{"grep", "fix"}, nil, "|&"},
+			{nil, []string{"less"}, nil, ""},
+		}},
+		{"make 2>&1 >out &>all <in", []parsed{{nil, []string{"make"}, []string{"2>&1", ">out", "&>all", "<in"}, ""}}},
+		{"echo a>b 2> err", []parsed{{nil, []string{"echo", "a"}, []string{">b", "2>err"}, ""}}},
+		{"echo $(date; echo ')') `id` ${HOME}", []parsed{{nil, []string{"echo", "$(date; echo ')')", "`id`", "${HOME}"}, nil, ""}}},
+		{"(cd dir && make) | tee log", []parsed{
+			{nil, []string{"cd", "dir"}, nil, "&&"},
+			{nil, []string{"make"}, nil, "|"},
+			{nil, []string{"tee", "log"}, nil, ""},
+		}},
+		{"cat <<EOF | wc -l\nls; rm -rf /\nEOF\necho done", []parsed{
+			{nil, []string{"cat"}, []string{"<<EOF"}, "|"},
+			{nil, []string{"wc", "-l"}, nil, ";"},
+			{nil, []string{"echo", "done"}, nil, ""},
+		}},
+		{"cat <<-'END'\n\tbody\n\tEND", []parsed{{nil, []string{"cat"}, []string{"<<-END"}, ""}}},
+		{"make \\\n  test # comment", []parsed{{nil, []string{"make", "test"}, nil, ""}}},
+		{"echo ''", []parsed{{nil, []string{"echo", ""}, nil, ""}}},
+		{"", nil},
+	} {
+		if commands := parseLine(t, test.line); !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%q: expected %v, got %v", test.line, test.commands, commands)
+		}
+	}
+
+	for _, line := range []string{`echo "a`, "echo 'a", "echo $(date", "cat <<EOF\nbody"} {
+		if _, err := ParseCommandLine(line); err == nil {
+			t.Errorf("%q should fail", line)
+		}
+	}
+
+	line := "  sudo -u root make"
+	l, _ := ParseCommandLine(line)
+	if w := l.Commands[0].Program(); w == nil || line[w.Start:w.End] != "make" {
+		t.Error("the program's offsets should be in the line, got", w)
+	}
+}
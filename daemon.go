@@ -0,0 +1,246 @@
+package r
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// dialTimeout is how long a Session waits to reach the daemon
+// before using the database directly
+const dialTimeout = 100 * time.Millisecond
+
+// readTimeout is how long the daemon waits for a request before
+// dropping the connection
+const readTimeout = 5 * time.Second
+
+// request is sent by a Session to the daemon. Session carries
+// the flags the daemon answers with
+type request struct {
+	Op       string
+	Session  *Session
+	Env      map[string]string
+	Path     string
+	Command  string
+	Commands []*Command
+	Records  []*Record
+	Policy   string
+	Run      *Run
+	DryRun   bool
+	Peer     string
+	Since    time.Time
+	Entries  []*syncEntry
+	Names    []string
+}
+
+// response is the daemon's answer to a request
+type response struct {
+	Error    string
+	Commands []*Command
+	Runs     []*Run
+	Line     string
+	Changes  []string
+	Records  []*Record
+	Origin   string
+	Since    time.Time
+	Entries  []*syncEntry
+	Count    int
+	Names    []string
+}
+
+// commands returns the commands of the response for the Results methods
+func (resp *response) commands(err error) ([]*Command, error) {
+	if err != nil {
+		return nil, err
+	}
+	return resp.Commands, nil
+}
+
+// remote sends req to the daemon listening on Socket. It returns false when
+// no daemon is listening so the Session uses the database directly
+func (s *Session) remote(req *request) (*response, bool, error) {
+	if s.Socket == "" || s.Store != nil {
+		return nil, false, nil
+	}
+
+	conn, err := net.DialTimeout("unix", s.Socket, dialTimeout)
+	if err != nil {
+		return nil, false, nil
+	}
+	defer conn.Close()
+
+	// The daemon answers with this Session's flags and environment
+	req.Session = s
+	req.Env = make(map[string]string)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "R_") {
+			pair := strings.SplitN(kv, "=", 2)
+			req.Env[pair[0]] = pair[1]
+		}
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, true, err
+	}
+
+	resp := new(response)
+	err = json.NewDecoder(conn).Decode(resp)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.Error != "" {
+		return resp, true, errors.New(resp.Error)
+	}
+
+	return resp, true, nil
+}
+
+// Serve answers the requests of Sessions connecting to l from the Store of
+// the Session, holding the database at BoltPath open when there's no
+// Store. It returns when l is closed
+func (s *Session) Serve(l net.Listener) error {
+	return s.serve(l, readTimeout)
+}
+
+// serve is Serve dropping clients that don't send their request
+// within timeout
+func (s *Session) serve(l net.Listener, timeout time.Duration) error {
+	if s.Store == nil {
+		store, err := s.openStore()
+		if err != nil {
+			return err
+		}
+		s.Store = store
+		defer func() {
+			s.Store = nil
+			store.Close()
+		}()
+	}
+
+	// Upgrade the database once before any client uses it
+	_, err := s.Migrate(false)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handle(conn, timeout)
+	}
+}
+
+// handle answers a single request
+func (s *Session) handle(conn net.Conn, timeout time.Duration) {
+	defer conn.Close()
+
+	// A client that never sends its request doesn't hold a goroutine
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return
+	}
+
+	req := new(request)
+	err = json.NewDecoder(conn).Decode(req)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Answer with the client's flags on the held database
+	client := new(Session)
+	if req.Session != nil {
+		*client = *req.Session
+	}
+	client.BoltPath = s.BoltPath
+	client.Socket = ""
+	client.Store = s.Store
+	client.env = req.Env
+	if client.env == nil {
+		client.env = make(map[string]string)
+	}
+
+	resp := client.dispatch(req)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// dispatch runs the request on the Session
+func (s *Session) dispatch(req *request) *response {
+	resp := new(response)
+
+	var err error
+	switch req.Op {
+	case "reset-last":
+		err = s.ResetLastCommand()
+	case "check":
+		err = s.checkForHistory(req.Path)
+	case "store-last":
+		err = s.StoreLastCommand(req.Command)
+	case "last":
+		resp.Line, err = s.LastCommand()
+	case "results-directory":
+		resp.Commands, err = s.ResultsDirectory(req.Path)
+	case "results-global":
+		resp.Commands, err = s.ResultsGlobal()
+	case "results-tree":
+		resp.Commands, err = s.ResultsTree(req.Path)
+	case "results-repo":
+		resp.Commands, err = s.ResultsRepo(req.Path)
+	case "results-archive":
+		resp.Commands, err = s.ResultsArchive(req.Path)
+	case "restore":
+		err = s.Restore(req.Command)
+	case "add":
+		if req.Run == nil {
+			err = errors.New("add request without a run")
+			break
+		}
+		err = s.addRun(req.Command, req.Run)
+	case "import":
+		err = s.importCommands(req.Commands)
+	case "records":
+		resp.Records, err = s.Records()
+	case "import-records":
+		err = s.ImportRecords(req.Records, req.Policy)
+	case "prune":
+		err = s.Prune(req.Path)
+	case "runs":
+		resp.Runs, err = s.Runs(req.Command)
+	case "sync-origin":
+		resp.Origin, err = s.syncOrigin()
+	case "sync-since":
+		resp.Since, err = s.syncSince(req.Peer)
+	case "sync-delta":
+		resp.Entries, err = s.syncDelta(req.Peer, req.Since)
+	case "sync-apply":
+		resp.Count, err = s.syncApply(req.Peer, req.Entries)
+	case "rescan":
+		resp.Count, err = s.Rescan()
+	case "executables":
+		var found map[string]bool
+		found, err = s.Executables(req.Path, req.Names)
+		for _, name := range req.Names {
+			if found[name] {
+				resp.Names = append(resp.Names, name)
+			}
+		}
+	case "migrate":
+		resp.Changes, err = s.Migrate(req.DryRun)
+	default:
+		err = errors.New("unknown request " + req.Op)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	return resp
+}
@@ -0,0 +1,216 @@
+package r
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	executableBucket = "ExecutableBucket" // BoltDB bucket caching the executables of each $PATH directory, one nested bucket per directory
+	pathMtimeBucket  = "PathMtimeBucket"  // BoltDB bucket storing the modification time of each cached $PATH directory
+)
+
+// pathDir is a directory of $PATH and its modification time, 0 when it
+// doesn't exist
+type pathDir struct {
+	path  string
+	mtime int64
+}
+
+// pathDirs returns the directories of path, a $PATH like list
+func pathDirs(path string) []*pathDir {
+	var dirs []*pathDir
+	seen := make(map[string]bool)
+	for _, p := range strings.Split(path, ":") {
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+
+		dir := &pathDir{path: p}
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			dir.mtime = info.ModTime().UnixNano()
+		}
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
+
+// stale checks if the cached executables of the directory are out of date
+func (dir *pathDir) stale(tx Tx) bool {
+	b := tx.Bucket([]byte(pathMtimeBucket))
+	if b == nil {
+		return true
+	}
+
+	v := b.Get([]byte(dir.path))
+	return v == nil || string(v) != strconv.FormatInt(dir.mtime, 10)
+}
+
+// scanExecutables reads the executables of dirs in parallel. Every
+// directory gets its own slot so the scans don't share anything
+func scanExecutables(dirs []*pathDir) ([][]string, error) {
+	names := make([][]string, len(dirs))
+	errs := make([]error, len(dirs))
+
+	var wg sync.WaitGroup
+	for i, dir := range dirs {
+		if dir.mtime == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, dir *pathDir) {
+			defer wg.Done()
+
+			files, err := ioutil.ReadDir(dir.path)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			for _, f := range files {
+				// Check if file is executable
+				if f.Mode()&0111 != 0 {
+					names[i] = append(names[i], f.Name())
+				}
+			}
+		}(i, dir)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
+
+// putExecutables replaces the cached executables of dir with names
+func putExecutables(tx Tx, dir *pathDir, names []string) error {
+	root, err := tx.CreateBucketIfNotExists([]byte(executableBucket))
+	if err != nil {
+		return err
+	}
+
+	if root.Bucket([]byte(dir.path)) != nil {
+		err = root.DeleteBucket([]byte(dir.path))
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := root.CreateBucketIfNotExists([]byte(dir.path))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = b.Put([]byte(name), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	mtimes, err := tx.CreateBucketIfNotExists([]byte(pathMtimeBucket))
+	if err != nil {
+		return err
+	}
+	return mtimes.Put([]byte(dir.path), []byte(strconv.FormatInt(dir.mtime, 10)))
+}
+
+// lookExecutables returns which of names are cached in the directories
+func lookExecutables(tx Tx, dirs []*pathDir, names []string) map[string]bool {
+	found := make(map[string]bool)
+
+	root := tx.Bucket([]byte(executableBucket))
+	if root == nil {
+		return found
+	}
+
+	for _, dir := range dirs {
+		b := root.Bucket([]byte(dir.path))
+		if b == nil {
+			continue
+		}
+
+		for _, name := range names {
+			if b.Get([]byte(name)) != nil {
+				found[name] = true
+			}
+		}
+	}
+
+	return found
+}
+
+// Executables returns which of names are executables in the directories
+// of path, a $PATH like list. The executables of every directory are
+// cached in the database and only read again when the directory's
+// modification time changes
+func (s *Session) Executables(path string, names []string) (map[string]bool, error) {
+	if resp, ok, err := s.remote(&request{Op: "executables", Path: path, Names: names}); ok {
+		if err != nil {
+			return nil, err
+		}
+
+		found := make(map[string]bool)
+		for _, name := range resp.Names {
+			found[name] = true
+		}
+		return found, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := pathDirs(path)
+
+	var stale []*pathDir
+	var found map[string]bool
+	err = db.View(func(tx Tx) error {
+		for _, dir := range dirs {
+			if dir.stale(tx) {
+				stale = append(stale, dir)
+			}
+		}
+
+		found = lookExecutables(tx, dirs, names)
+		return nil
+	})
+
+	// Only directories that changed are read again
+	if err == nil && len(stale) > 0 {
+		var scanned [][]string
+		scanned, err = scanExecutables(stale)
+		if err == nil {
+			err = db.Update(func(tx Tx) error {
+				for i, dir := range stale {
+					err := putExecutables(tx, dir, scanned[i])
+					if err != nil {
+						return err
+					}
+				}
+
+				found = lookExecutables(tx, dirs, names)
+				return nil
+			})
+		}
+	}
+
+	s.close(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
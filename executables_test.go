@@ -0,0 +1,71 @@
+package r
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecutables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, perm os.FileMode, mtime time.Time) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(dir, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := new(Session)
+	s.Store = NewMemoryStore()
+
+	path := dir + ":" + filepath.Join(dir, "missing") + "::" + dir
+	names := []string{"build", "notes", "deploy"}
+
+	mtime := time.Now().Add(-time.Hour)
+	write("build", 0755, mtime)
+	write("notes", 0644, mtime)
+
+	found, err := s.Executables(path, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || !found["build"] {
+		t.Error("only build should be found, got", found)
+	}
+
+	// The directory isn't read again while its modification time is the same
+	err = os.Remove(filepath.Join(dir, "build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("deploy", 0755, mtime)
+
+	found, err = s.Executables(path, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || !found["build"] {
+		t.Error("the cached executables should be used, got", found)
+	}
+
+	write("deploy", 0755, mtime.Add(time.Minute))
+
+	found, err = s.Executables(path, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || !found["deploy"] {
+		t.Error("a modified directory should be read again, got", found)
+	}
+}
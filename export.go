@@ -0,0 +1,304 @@
+package r
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Conflict policies for a command stored both in the database and in
+// the records merged into it
+const (
+	MergeMax = "max" // Keep the highest count and the latest use
+	MergeSum = "sum" // Add the counts up and keep the latest use
+)
+
+// Record is a line of an export. It's either the command info of Command
+// in the global history, the directory Dir or the repository Repo, or
+// one Run of Command started at Time
+type Record struct {
+	Command  string    `json:"command"`
+	Dir      string    `json:"dir,omitempty"`
+	Repo     string    `json:"repo,omitempty"`
+	Archived bool      `json:"archived,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	Time     time.Time `json:"time"`
+	Exit     int       `json:"exit,omitempty"`
+	Run      *Run      `json:"run,omitempty"`
+}
+
+// names returns the path of the command info bucket of the record
+func (rec *Record) names() []string {
+	names := []string{globalCommandBucket}
+	switch {
+	case rec.Dir != "":
+		names = []string{directoryBucket, rec.Dir}
+	case rec.Repo != "":
+		names = []string{repoBucket, rec.Repo}
+	}
+
+	if rec.Archived {
+		names = append([]string{archiveBucket}, names...)
+	}
+
+	return names
+}
+
+// newRecord returns the record of the command info
+// stored for name in the bucket at names
+func newRecord(names []string, name string, ci *CommandInfo) *Record {
+	rec := &Record{Command: name, Count: ci.Count, Time: ci.Time, Exit: ci.Exit}
+	if names[0] == archiveBucket {
+		rec.Archived = true
+		names = names[1:]
+	}
+
+	switch names[0] {
+	case directoryBucket:
+		rec.Dir = names[1]
+	case repoBucket:
+		rec.Repo = names[1]
+	}
+
+	return rec
+}
+
+// mergeInfoPolicy merges the command info of a command stored twice
+// following the conflict policy
+func mergeInfoPolicy(policy string, a, b *CommandInfo) (*CommandInfo, error) {
+	switch policy {
+	case MergeMax:
+		return mergeInfo(a, b), nil
+	case MergeSum:
+		ci := mergeInfo(a, b)
+		ci.Count = a.Count + b.Count
+		return ci, nil
+	}
+
+	return nil, fmt.Errorf("unknown conflict policy %q. Use %s or %s", policy, MergeMax, MergeSum)
+}
+
+// Records returns every command info value, archived or not,
+// and every run stored in the database
+func (s *Session) Records() ([]*Record, error) {
+	if resp, ok, err := s.remote(&request{Op: "records"}); ok {
+		if err != nil {
+			return nil, err
+		}
+		return resp.Records, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	err = db.View(func(tx Tx) error {
+		for _, root := range [][]string{nil, {archiveBucket}} {
+			err := forEachInfoBucketIn(tx, root, func(names []string, b Bucket) error {
+				names = append(append([]string{}, root...), names...)
+				return b.ForEach(func(k, v []byte) error {
+					if v == nil || string(k) == hookArtifact {
+						return nil
+					}
+
+					ci := new(CommandInfo).NewFromString(string(v))
+					records = append(records, newRecord(names, string(k), ci))
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket([]byte(runBucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			runs, err := readRuns(tx, string(k))
+			if err != nil {
+				return err
+			}
+
+			for _, run := range runs {
+				records = append(records, &Record{Command: string(k), Time: run.Start, Exit: run.Exit, Run: run})
+			}
+			return nil
+		})
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Export writes every record of the database to w as JSON Lines
+func (s *Session) Export(w io.Writer) error {
+	records, err := s.Records()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, rec := range records {
+		err = enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ReadRecords reads the JSON Lines written by Export
+func ReadRecords(r io.Reader) ([]*Record, error) {
+	var records []*Record
+	scanner := newHistoryScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		rec := new(Record)
+		err := json.Unmarshal(scanner.Bytes(), rec)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if rec.Command == "" {
+			return nil, fmt.Errorf("line %d: record without a command", line)
+		}
+
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// ImportRecords merges records into the database. A command stored in
+// both is merged following the conflict policy, MergeMax or MergeSum.
+// Runs already stored are skipped and secrets are redacted. The history
+// of every directory and repository in records is pruned afterwards
+func (s *Session) ImportRecords(records []*Record, policy string) error {
+	// Check the policy before anything is sent to the daemon
+	_, err := mergeInfoPolicy(policy, new(CommandInfo), new(CommandInfo))
+	if err != nil {
+		return err
+	}
+
+	// Secrets are redacted before the records leave this process
+	var redacted []*Record
+	for _, rec := range records {
+		cmd, _, err := s.Redact(rec.Command)
+		if err != nil {
+			return err
+		}
+		if cmd == "" {
+			continue
+		}
+
+		copied := *rec
+		copied.Command = cmd
+		redacted = append(redacted, &copied)
+	}
+	records = redacted
+
+	if _, ok, err := s.remote(&request{Op: "import-records", Records: records, Policy: policy}); ok {
+		return err
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx Tx) error {
+		return s.importRecords(tx, records, policy)
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// importRecords merges records in tx then prunes
+func (s *Session) importRecords(tx Tx, records []*Record, policy string) error {
+	dirs := make(map[string]bool)
+	repos := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Run != nil {
+			err := putRunOnce(tx, rec.Command, rec.Run)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		ib, err := openInfo(tx, true, rec.names()...)
+		if err != nil {
+			return err
+		}
+
+		ci := &CommandInfo{Time: rec.Time, Count: rec.Count, Exit: rec.Exit}
+		if prev := ib.get(rec.Command); prev != nil {
+			ci, err = mergeInfoPolicy(policy, prev, ci)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = ib.put(rec.Command, ci)
+		if err != nil {
+			return err
+		}
+
+		if rec.Dir != "" && !rec.Archived {
+			dirs[rec.Dir] = true
+		}
+		if rec.Repo != "" && !rec.Archived {
+			repos[rec.Repo] = true
+		}
+	}
+
+	return s.pruneScopes(tx, dirs, repos)
+}
+
+// pruneScopes prunes the history of dirs and repos and the global history
+func (s *Session) pruneScopes(tx Tx, dirs, repos map[string]bool) error {
+	dirLimit, globalLimit := s.HistoryLimits()
+	mode := s.sortMode()
+	for dir := range dirs {
+		err := pruneInfo(tx, dirLimit, mode, directoryBucket, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	for repo := range repos {
+		err := pruneInfo(tx, dirLimit, mode, repoBucket, repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return pruneInfo(tx, globalLimit, mode, globalCommandBucket)
+}
@@ -0,0 +1,158 @@
+package r
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := new(Session)
+	src.Store = NewMemoryStore()
+
+	start := time.Now().Add(-time.Hour)
+	for i, cmd := range []string{"ls -a", "ls -b", "ls -a"} {
+		err := src.AddRun(cmd, &Run{Dir: "/tmp", Start: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := src.Export(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 global and 2 directory command infos then 3 runs
+	if lines := strings.Count(buf.String(), "\n"); lines != 7 {
+		t.Errorf("export should have 7 lines, got %d:\n%s", lines, buf.String())
+	}
+
+	records, err := ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := new(Session)
+	dst.Store = NewMemoryStore()
+
+	count := func() int {
+		results, err := dst.ResultsDirectory("/tmp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results[0].Name != "ls -a" {
+			t.Fatal("import should restore the directory history, got", namesOfCmds(results))
+		}
+		return results[0].Info.Count
+	}
+
+	for i, test := range []struct {
+		policy string
+		count  int
+	}{
+		{MergeMax, 2},
+		{MergeMax, 2},
+		{MergeSum, 4},
+	} {
+		err = dst.ImportRecords(records, test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := count(); got != test.count {
+			t.Errorf("import %d with %s: count should be %d, got %d", i, test.policy, test.count, got)
+		}
+	}
+
+	runs, err := dst.Runs("ls -a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Error("runs imported again should be skipped, got", len(runs))
+	}
+
+	if dst.ImportRecords(records, "min") == nil {
+		t.Error("unknown conflict policy should fail")
+	}
+
+	if _, err := ReadRecords(strings.NewReader("{\"count\": 1}\n")); err == nil {
+		t.Error("record without a command should fail")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	db := new(testDB)
+	db, err := db.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(db.TestPath)
+
+	other := new(Session)
+	other.BoltPath = db.TestPath
+	for _, dir := range []string{"/Users/me/src", "/Users/me/src", "/Users/meg"} {
+		err = other.AddRun("ls -la", &Run{Dir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := new(Session)
+	s.Store = NewMemoryStore()
+	err = s.AddRun("ls -la", &Run{Dir: "/home/me/src"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw, err := ParseRewrite("/Users/me=/home/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Merge(db.TestPath, []Rewrite{rw})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		dir   string
+		count int
+	}{
+		{"/home/me/src", 3},
+		{"/Users/meg", 1},
+	} {
+		results, err := s.ResultsDirectory(test.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Info.Count != test.count {
+			t.Errorf("%s should have a count of %d, got %v", test.dir, test.count, results)
+		}
+	}
+
+	results, err := s.ResultsGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Info.Count != 4 {
+		t.Error("global counts should be added up, got", results)
+	}
+
+	runs, err := s.Runs("ls -la")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 4 || runs[1].Dir != "/home/me/src" {
+		t.Error("runs should be merged with their directory rewritten, got", len(runs))
+	}
+
+	other.Store = nil
+	if _, err := other.Merge(db.TestPath, nil); err == nil {
+		t.Error("merging a database into itself should fail")
+	}
+}
@@ -0,0 +1,91 @@
+package r
+
+import (
+	"math"
+	"time"
+)
+
+// Sort modes
+const (
+	sortTime = iota
+	sortUsage
+	sortFrecency
+)
+
+// defaultHalfLife is how long it takes a run to count half as much
+const defaultHalfLife = 7 * 24 * time.Hour
+
+// halfLife returns the frecency half-life from the Session, then
+// R_FRECENCY_HALFLIFE (ex. "72h") and then the default
+func (s *Session) halfLife() time.Duration {
+	if s.HalfLife > 0 {
+		return s.HalfLife
+	}
+
+	d, err := time.ParseDuration(s.getenv("R_FRECENCY_HALFLIFE"))
+	if err != nil || d <= 0 {
+		return defaultHalfLife
+	}
+
+	return d
+}
+
+// decay is how much a run at t counts at now. A run counts 1 when it just
+// happened and half as much every halfLife after
+func decay(t, now time.Time, halfLife time.Duration) float64 {
+	age := now.Sub(t)
+	if age < 0 {
+		age = 0
+	}
+
+	return math.Pow(0.5, float64(age)/float64(halfLife))
+}
+
+// frecency scores a command by adding up the decayed weight of every run.
+// When keep isn't nil only the runs it keeps count. Uses without a stored
+// run, recorded before the run log existed or trimmed from it, are
+// counted as happening at the oldest stored run or, without runs, at the
+// last used time
+func frecency(ci *CommandInfo, runs []*Run, keep func(*Run) bool, now time.Time, halfLife time.Duration) float64 {
+	score := 0.0
+	count := 0
+	for _, run := range runs {
+		if keep != nil && !keep(run) {
+			continue
+		}
+
+		score += decay(run.Start, now, halfLife)
+		count++
+	}
+
+	if missing := ci.Count - count; missing > 0 {
+		oldest := ci.Time
+		if len(runs) > 0 {
+			oldest = runs[0].Start
+		}
+		score += float64(missing) * decay(oldest, now, halfLife)
+	}
+
+	return score
+}
+
+// scoreFrecency sets the Frecency of every result from the runs keep
+// keeps when commands are sorted by frecency
+func (s *Session) scoreFrecency(tx Tx, results []*Command, keep func(*Run) bool) error {
+	if s.sortMode() != sortFrecency {
+		return nil
+	}
+
+	now := time.Now()
+	halfLife := s.halfLife()
+	for _, cmd := range results {
+		runs, err := readRuns(tx, cmd.Name)
+		if err != nil {
+			return err
+		}
+
+		cmd.Frecency = frecency(cmd.Info, runs, keep, now, halfLife)
+	}
+
+	return nil
+}
@@ -0,0 +1,205 @@
+package r
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Scores added for each matched character
+const (
+	scoreMatch       = 1 // Every matched character
+	scoreConsecutive = 5 // Character directly follows the previous match
+	scoreBoundary    = 3 // Character starts a word
+	scoreProgram     = 2 // Character is in the program a command runs, ex. git in git status
+	maxGapPenalty    = 5 // Most a gap between two matches costs
+)
+
+// Match is a command matching a fuzzy search pattern
+type Match struct {
+	*Command
+	// Score is higher the better the command matches
+	Score int
+	// Positions are the rune indexes in the Name of every matched character
+	Positions []int
+}
+
+// byScore sorts by best match
+type byScore []*Match
+
+// Len used for sorting
+func (s byScore) Len() int {
+	return len(s)
+}
+
+// Less used for sorting
+func (s byScore) Less(i, j int) bool {
+	return s[i].Score > s[j].Score
+}
+
+// Swap used for sorting
+func (s byScore) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// FuzzyMatch checks if every whitespace separated token of pattern is
+// found in name with its characters in order but not necessarily next to
+// each other. Tokens in lower case match any case. Characters matched in
+// the programs name runs score higher. It returns the score of the match
+// and the rune indexes of the matched characters
+func FuzzyMatch(pattern, name string) (int, []int, bool) {
+	// Lower case rune by rune so positions match the runes of name.
+	// strings.ToLower can change how many runes there are
+	runes := []rune(name)
+	lower := make([]rune, len(runes))
+	for i, c := range runes {
+		lower[i] = unicode.ToLower(c)
+	}
+
+	total := 0
+	var positions []int
+	for _, token := range strings.Fields(pattern) {
+		target := runes
+		if strings.ToLower(token) == token {
+			target = lower
+		}
+
+		score, pos, ok := matchToken([]rune(token), target)
+		if !ok {
+			return 0, nil, false
+		}
+
+		total += score
+		positions = append(positions, pos...)
+	}
+
+	// Tokens can match the same characters
+	sort.Ints(positions)
+	unique := positions[:0]
+	for i, pos := range positions {
+		if i == 0 || pos != positions[i-1] {
+			unique = append(unique, pos)
+		}
+	}
+
+	programs := programRunes(name)
+	for _, pos := range unique {
+		if programs[pos] {
+			total += scoreProgram
+		}
+	}
+
+	return total, unique, true
+}
+
+// programRunes returns the rune indexes of the programs name runs
+func programRunes(name string) map[int]bool {
+	line, err := ParseCommandLine(name)
+	if err != nil {
+		return nil
+	}
+
+	runes := make(map[int]bool)
+	for _, c := range line.Commands {
+		w := c.Program()
+		if w == nil {
+			continue
+		}
+
+		start := utf8.RuneCountInString(name[:w.Start])
+		for i := range []rune(name[w.Start:w.End]) {
+			runes[start+i] = true
+		}
+	}
+
+	return runes
+}
+
+// matchToken tries matching token starting from every occurrence of its
+// first character in target and keeps the best scoring one
+func matchToken(token, target []rune) (int, []int, bool) {
+	bestScore := 0
+	var best []int
+	for start := range target {
+		if target[start] != token[0] {
+			continue
+		}
+
+		score, pos, ok := matchFrom(token, target, start)
+		if ok && (best == nil || score > bestScore) {
+			bestScore = score
+			best = pos
+		}
+	}
+
+	return bestScore, best, best != nil
+}
+
+// matchFrom greedily matches token in target from start
+func matchFrom(token, target []rune, start int) (int, []int, bool) {
+	score := 0
+	pos := make([]int, 0, len(token))
+	i := start
+	for _, c := range token {
+		for i < len(target) && target[i] != c {
+			i++
+		}
+		if i == len(target) {
+			return 0, nil, false
+		}
+
+		score += scoreMatch
+		if i == 0 || isBoundary(target[i-1]) {
+			score += scoreBoundary
+		}
+		if len(pos) > 0 {
+			gap := i - pos[len(pos)-1] - 1
+			if gap == 0 {
+				score += scoreConsecutive
+			} else if gap < maxGapPenalty {
+				score -= gap
+			} else {
+				score -= maxGapPenalty
+			}
+		}
+
+		pos = append(pos, i)
+		i++
+	}
+
+	return score, pos, true
+}
+
+// isBoundary checks if the rune separates words in a command
+func isBoundary(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("/-_.=:,;|&'\"", r)
+}
+
+// Match filters results to the commands matching pattern. The order of
+// results is kept and commands the sort mode ranks the same are ordered
+// by their match score
+func (s *Session) Match(results []*Command, pattern string) []*Match {
+	var matches []*Match
+	for _, cmd := range results {
+		score, pos, ok := FuzzyMatch(pattern, cmd.Name)
+		if !ok {
+			continue
+		}
+
+		matches = append(matches, &Match{Command: cmd, Score: score, Positions: pos})
+	}
+
+	// Break ties within each group of equally ranked commands
+	for start := 0; start < len(matches); {
+		end := start + 1
+		for end < len(matches) && s.sameRank(matches[start].Command, matches[end].Command) {
+			end++
+		}
+
+		sort.Stable(byScore(matches[start:end]))
+		start = end
+	}
+
+	return matches
+}
@@ -0,0 +1,89 @@
+package r
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		ok      bool
+	}{
+		{"", "go build", true},
+		{"gb", "go build", true},
+		{"build", "go build ./...", true},
+		{"bld go", "go build", true},
+		{"BUILD", "go build", false},
+		{"Build", "go Build", true},
+		{"tset", "go test", false},
+		{"gt x", "go test", false},
+	}
+
+	for _, test := range tests {
+		_, _, ok := FuzzyMatch(test.pattern, test.name)
+		if ok != test.ok {
+			t.Errorf("FuzzyMatch(%q, %q) = %v, want %v", test.pattern, test.name, ok, test.ok)
+		}
+	}
+
+	_, positions, _ := FuzzyMatch("gb", "go build")
+	if len(positions) != 2 || positions[0] != 0 || positions[1] != 3 {
+		t.Error("gb should match the word starts of go build, got", positions)
+	}
+
+	// İ lower cases to two runes with strings.ToLower
+	_, positions, _ = FuzzyMatch("x", "İx")
+	if len(positions) != 1 || positions[0] != 1 {
+		t.Error("positions should be rune indexes of the name, got", positions)
+	}
+
+	// A substring scores higher than scattered characters
+	substring, _, _ := FuzzyMatch("test", "go test")
+	scattered, _, _ := FuzzyMatch("test", "tar -e stat")
+	if substring <= scattered {
+		t.Error("substring should score higher", substring, scattered)
+	}
+
+	// A match in the program scores higher than in an argument
+	program, _, _ := FuzzyMatch("make", "make test")
+	argument, _, _ := FuzzyMatch("make", "cd make")
+	if program <= argument {
+		t.Error("program should score higher", program, argument)
+	}
+}
+
+func TestMatchKeepsSortOrder(t *testing.T) {
+	now := time.Now()
+	results := []*Command{
+		{Name: "make test", Info: &CommandInfo{Time: now, Count: 5}},
+		{Name: "terraform state list", Info: &CommandInfo{Time: now, Count: 2}},
+		{Name: "go test", Info: &CommandInfo{Time: now, Count: 2}},
+		{Name: "test", Info: &CommandInfo{Time: now, Count: 1}},
+		{Name: "ls", Info: &CommandInfo{Time: now, Count: 1}},
+	}
+
+	s := new(Session)
+	s.SortUsage = true
+
+	matches := s.Match(results, "test")
+	if len(matches) != 4 {
+		t.Fatal("there should be 4 matches, got", len(matches))
+	}
+
+	// The sort order is kept even when a later command matches better
+	if matches[0].Name != "make test" || matches[3].Name != "test" {
+		t.Error("sort order should be kept, got", matches[0].Name, matches[3].Name)
+	}
+
+	// Both commands are tied on usage so the better match wins
+	if matches[1].Name != "go test" {
+		t.Error("ties should be broken by score, got", matches[1].Name)
+	}
+
+	matches = s.Match(results, "go t")
+	if len(matches) != 1 || matches[0].Name != "go test" {
+		t.Error("only go test should match")
+	}
+}
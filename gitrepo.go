@@ -0,0 +1,246 @@
+package r
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	repoBucket   = "RepoBucket"   // BoltDB bucket storing commands per git repository
+	repoIDBucket = "RepoIDBucket" // BoltDB bucket caching the root commit of each git directory
+)
+
+// gitRepo is a git repository found on disk
+type gitRepo struct {
+	gitDir    string // .git directory of the worktree
+	commonDir string // .git directory shared by every worktree
+}
+
+// findRepo looks for the git repository containing path by reading the
+// .git directory or file of path and its parents. It returns nil
+// outside of a git repository
+func findRepo(path string) (*gitRepo, error) {
+	dir := filepath.Clean(path)
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		info, err := os.Stat(dotGit)
+		if err == nil {
+			repo := &gitRepo{gitDir: dotGit}
+
+			// Worktrees and submodules have a .git file pointing to the git directory
+			if !info.IsDir() {
+				repo.gitDir, err = readGitFile(dotGit)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			// Worktrees share the config and objects of the main repository
+			repo.commonDir = repo.gitDir
+			common, err := ioutil.ReadFile(filepath.Join(repo.gitDir, "commondir"))
+			if err == nil {
+				repo.commonDir = relativeTo(repo.gitDir, strings.TrimSpace(string(common)))
+			}
+
+			return repo, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// readGitFile returns the git directory a "gitdir: <path>" .git file points to
+func readGitFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	line := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(line, "gitdir:") {
+		return "", fmt.Errorf("invalid .git file %s", path)
+	}
+
+	return relativeTo(filepath.Dir(path), strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))), nil
+}
+
+// relativeTo resolves path against dir when it isn't absolute
+func relativeTo(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(dir, path)
+}
+
+// remoteID returns the normalized URL of the origin remote or, without
+// an origin, of the first remote in the config
+func (repo *gitRepo) remoteID() string {
+	f, err := os.Open(filepath.Join(repo.commonDir, "config"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	var remote, first string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			remote = ""
+			if strings.HasPrefix(line, "[remote ") {
+				remote = strings.Trim(strings.TrimPrefix(line, "[remote "), `"] `)
+			}
+			continue
+		}
+
+		if remote == "" {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "url" {
+			continue
+		}
+
+		url := normalizeURL(strings.TrimSpace(kv[1]))
+		if remote == "origin" {
+			return url
+		}
+		if first == "" {
+			first = url
+		}
+	}
+
+	return first
+}
+
+// normalizeURL reduces the different forms of a remote URL to host/path
+// so ex. https://github.com/jesselucas/r.git and git@github.com:jesselucas/r
+// are the same repository
+func normalizeURL(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	} else if i := strings.Index(url, ":"); i >= 0 && !strings.Contains(url[:i], "/") {
+		// scp-like syntax user@host:path
+		url = url[:i] + "/" + url[i+1:]
+	}
+
+	// Drop the user
+	if i := strings.Index(url, "@"); i >= 0 && i < strings.Index(url+"/", "/") {
+		url = url[i+1:]
+	}
+
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+
+	// Host names are case insensitive
+	if i := strings.Index(url, "/"); i >= 0 {
+		return strings.ToLower(url[:i]) + url[i:]
+	}
+	return strings.ToLower(url)
+}
+
+// rootCommit asks git for the commit the repository started with,
+// following the first parent of HEAD. It returns an empty string when git
+// isn't installed or HEAD doesn't have commits yet
+func (repo *gitRepo) rootCommit() string {
+	out, err := exec.Command("git", "--git-dir", repo.gitDir,
+		"rev-list", "--first-parent", "--max-parents=0", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+
+	roots := strings.Fields(string(out))
+	if len(roots) == 0 {
+		return ""
+	}
+	return roots[0]
+}
+
+// repoID returns the identity of the git repository containing path so
+// its history follows the project across clones and worktrees. It's the
+// normalized URL of its remote or, for repositories without a remote, its
+// root commit. The root commit is cached in db since finding it runs git,
+// so repoID is called before the transaction using the identity. It
+// returns an empty string outside of a git repository or in a repository
+// without commits. Repositories that can't be read are treated like plain
+// directories
+func repoID(db Store, path string) (string, error) {
+	repo, err := findRepo(path)
+	if err != nil || repo == nil {
+		return "", nil
+	}
+
+	if url := repo.remoteID(); url != "" {
+		return url, nil
+	}
+
+	var id string
+	err = db.View(func(tx Tx) error {
+		if b := tx.Bucket([]byte(repoIDBucket)); b != nil {
+			id = string(b.Get([]byte(repo.commonDir)))
+		}
+		return nil
+	})
+	if err != nil || id != "" {
+		return id, err
+	}
+
+	root := repo.rootCommit()
+	if root == "" {
+		return "", nil
+	}
+	id = "root:" + root
+
+	err = db.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(repoIDBucket))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(repo.commonDir), []byte(id))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// ResultsRepo returns the command history of the git repository
+// containing path from every clone and worktree of it
+func (s *Session) ResultsRepo(path string) ([]*Command, error) {
+	if resp, ok, err := s.remote(&request{Op: "results-repo", Path: path}); ok {
+		return resp.commands(err)
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*Command
+	id, err := repoID(db, path)
+	if err == nil && id != "" {
+		err = db.View(func(tx Tx) error {
+			results, err = s.readInfo(tx, inRepo(id), repoBucket, id)
+			return err
+		})
+	}
+
+	s.close(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
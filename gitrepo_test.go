@@ -0,0 +1,113 @@
+package r
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	urls := []string{
+		"https://github.com/jesselucas/r.git",
+		"https://user@GitHub.com/jesselucas/r/",
+		"git@github.com:jesselucas/r.git",
+		"ssh://git@github.com/jesselucas/r",
+		"github.com:jesselucas/r",
+	}
+
+	for _, url := range urls {
+		if got := normalizeURL(url); got != "github.com/jesselucas/r" {
+			t.Errorf("normalizeURL(%q) = %q", url, got)
+		}
+	}
+}
+
+// git runs a git command in dir for building test repositories
+func git(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=r", "GIT_AUTHOR_EMAIL=r@example.com",
+		"GIT_COMMITTER_NAME=r", "GIT_COMMITTER_EMAIL=r@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestRootCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is needed to build the test repository")
+	}
+
+	dir, err := ioutil.TempDir("", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	main := filepath.Join(dir, "main")
+	os.Mkdir(main, 0755)
+	git(t, main, "init", "-q")
+
+	// A repository without commits has no root
+	repo, err := findRepo(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := repo.rootCommit(); got != "" {
+		t.Error("a repository without commits shouldn't have a root commit, got", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		git(t, main, "commit", "-q", "--allow-empty", "-m", "commit")
+	}
+	root := git(t, main, "rev-list", "--max-parents=0", "HEAD")
+
+	if got := repo.rootCommit(); got != root {
+		t.Fatal("root commit should be", root, "got", got)
+	}
+
+	// Worktrees share the repository identity
+	worktree := filepath.Join(dir, "worktree")
+	git(t, main, "worktree", "add", "-q", worktree)
+	os.MkdirAll(filepath.Join(worktree, "sub"), 0755)
+
+	db := new(testDB)
+	db, err = db.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(db.TestPath)
+
+	s := new(Session)
+	s.BoltPath = db.TestPath
+	err = s.Add(&Execution{Command: "ls main", Dir: main})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(&Execution{Command: "ls worktree", Dir: filepath.Join(worktree, "sub")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.ResultsRepo(worktree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Error("worktree should share history with the main checkout, got", namesOfCmds(results))
+	}
+
+	// A remote takes over as the identity
+	git(t, main, "remote", "add", "origin", "git@github.com:jesselucas/r.git")
+	repo, _ = findRepo(worktree)
+	if id := repo.remoteID(); id != "github.com/jesselucas/r" {
+		t.Error("remote should identify the repository, got", id)
+	}
+}
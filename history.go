@@ -0,0 +1,345 @@
+package r
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnknownDir is the directory bucket imported commands are stored
+// in since shell history files don't record where commands ran
+const UnknownDir = "(unknown directory)"
+
+// historyEntry is a single command read from a shell history file
+type historyEntry struct {
+	line string
+	time time.Time
+}
+
+// ParseHistory reads the history file of shell (bash, zsh or fish) and
+// returns every command in it with how many times it was used and when it
+// was last used. Commands without a timestamp are dated modTime, usually
+// the modification time of the file. Multi-line commands are skipped and
+// counted in the returned int
+func ParseHistory(shell string, r io.Reader, modTime time.Time) ([]*Command, int, error) {
+	var entries []historyEntry
+	var err error
+	switch shell {
+	case "bash":
+		entries, err = parseBashHistory(r, modTime)
+	case "zsh":
+		entries, err = parseZshHistory(r, modTime)
+	case "fish":
+		entries, err = parseFishHistory(r, modTime)
+	default:
+		return nil, 0, fmt.Errorf("unknown shell %q. Use bash, zsh or fish", shell)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	skipped := 0
+	infos := make(map[string]*CommandInfo)
+	for _, entry := range entries {
+		line := strings.TrimSpace(entry.line)
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, "\n") {
+			skipped++
+			continue
+		}
+
+		ci := infos[line]
+		if ci == nil {
+			ci = new(CommandInfo)
+			infos[line] = ci
+		}
+
+		ci.Count++
+		if entry.time.After(ci.Time) {
+			ci.Time = entry.time
+		}
+	}
+
+	var cmds []*Command
+	for name, ci := range infos {
+		cmds = append(cmds, &Command{Name: name, Info: ci})
+	}
+	sort.Sort(byName(cmds))
+
+	return cmds, skipped, nil
+}
+
+// byName sorts commands by name
+type byName []*Command
+
+// Len used for sorting
+func (s byName) Len() int {
+	return len(s)
+}
+
+// Less used for sorting
+func (s byName) Less(i, j int) bool {
+	return s[i].Name < s[j].Name
+}
+
+// Swap used for sorting
+func (s byName) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// newHistoryScanner returns a line scanner allowing very long commands
+func newHistoryScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+// parseUnix parses a Unix timestamp in seconds
+func parseUnix(s string) (time.Time, bool) {
+	sec, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(sec, 0), true
+}
+
+// parseBashHistory reads ~/.bash_history. With HISTTIMEFORMAT set bash
+// writes a "#<unix time>" line before each command
+func parseBashHistory(r io.Reader, modTime time.Time) ([]historyEntry, error) {
+	var entries []historyEntry
+	var stamp time.Time
+	scanner := newHistoryScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			if t, ok := parseUnix(line[1:]); ok {
+				stamp = t
+				continue
+			}
+		}
+
+		entry := historyEntry{line: line, time: modTime}
+		if !stamp.IsZero() {
+			entry.time = stamp
+			stamp = time.Time{}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseZshHistory reads ~/.zsh_history in the plain or the extended
+// ": <unix time>:<duration>;<command>" format. Lines ending in a
+// backslash continue on the next line
+func parseZshHistory(r io.Reader, modTime time.Time) ([]historyEntry, error) {
+	var entries []historyEntry
+	continued := false
+	scanner := newHistoryScanner(r)
+	for scanner.Scan() {
+		line := unmetafy(scanner.Text())
+
+		if continued {
+			last := &entries[len(entries)-1]
+			last.line = strings.TrimSuffix(last.line, "\\") + "\n" + line
+			continued = strings.HasSuffix(line, "\\")
+			continue
+		}
+
+		entry := historyEntry{line: line, time: modTime}
+		if strings.HasPrefix(line, ": ") {
+			if i := strings.Index(line, ";"); i > 0 {
+				stamp := strings.SplitN(line[2:i], ":", 2)[0]
+				if t, ok := parseUnix(stamp); ok {
+					entry = historyEntry{line: line[i+1:], time: t}
+				}
+			}
+		}
+
+		entries = append(entries, entry)
+		continued = strings.HasSuffix(line, "\\")
+	}
+
+	return entries, scanner.Err()
+}
+
+// unmetafy decodes the bytes zsh escapes in its history file. An escaped
+// byte is written as 0x83 followed by the byte xor 32
+func unmetafy(line string) string {
+	if strings.IndexByte(line, 0x83) < 0 {
+		return line
+	}
+
+	b := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		if line[i] == 0x83 && i+1 < len(line) {
+			i++
+			b = append(b, line[i]^32)
+			continue
+		}
+		b = append(b, line[i])
+	}
+
+	return string(b)
+}
+
+// parseFishHistory reads fish's fish_history, a list of
+// "- cmd: <command>" items each followed by "  when: <unix time>"
+func parseFishHistory(r io.Reader, modTime time.Time) ([]historyEntry, error) {
+	var entries []historyEntry
+	scanner := newHistoryScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "- cmd: ") {
+			cmd := unescapeFish(strings.TrimPrefix(line, "- cmd: "))
+			entries = append(entries, historyEntry{line: cmd, time: modTime})
+			continue
+		}
+
+		if strings.HasPrefix(line, "  when: ") && len(entries) > 0 {
+			if t, ok := parseUnix(strings.TrimPrefix(line, "  when: ")); ok {
+				entries[len(entries)-1].time = t
+			}
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// unescapeFish decodes the backslash escapes fish writes for
+// newlines and backslashes in a command
+func unescapeFish(cmd string) string {
+	if !strings.Contains(cmd, "\\") {
+		return cmd
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] == '\\' && i+1 < len(cmd) {
+			switch cmd[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			case '\\':
+				b.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(cmd[i])
+	}
+
+	return b.String()
+}
+
+// Import merges commands read from a shell history into the global
+// history and the UnknownDir directory. Commands that aren't found in
+// $PATH or the shell's commands are skipped, so are commands Ignored
+// would keep from being recorded, and secrets are redacted. A
+// command already stored keeps the highest count and the latest use so
+// importing the same file again changes nothing. The history isn't
+// pruned so every imported command is kept until the next command is
+// stored. It returns how many commands were imported
+func (s *Session) Import(cmds []*Command) (int, error) {
+	var firsts []string
+	for _, cmd := range cmds {
+		firsts = append(firsts, firstCommand(cmd.Name))
+	}
+
+	executables, err := s.Executables(os.Getenv("PATH"), firsts)
+	if err != nil {
+		return 0, err
+	}
+
+	var valid []*Command
+	for i, cmd := range cmds {
+		first := firsts[i]
+		if first == "r" || !s.knownCommand(UnknownDir, first, executables) {
+			continue
+		}
+
+		ignored, err := s.Ignored(UnknownDir, cmd.Name)
+		if err != nil {
+			return 0, err
+		}
+		if ignored {
+			continue
+		}
+
+		name, _, err := s.Redact(cmd.Name)
+		if err != nil {
+			return 0, err
+		}
+		if name != "" {
+			valid = append(valid, &Command{Name: name, Info: cmd.Info})
+		}
+	}
+
+	// Commands are checked against this process's $PATH
+	// before they're sent to the daemon
+	if _, ok, err := s.remote(&request{Op: "import", Commands: valid}); ok {
+		if err != nil {
+			return 0, err
+		}
+		return len(valid), nil
+	}
+
+	err = s.importCommands(valid)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(valid), nil
+}
+
+// importCommands stores commands that were already checked
+func (s *Session) importCommands(cmds []*Command) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx Tx) error {
+		for _, names := range [][]string{
+			{globalCommandBucket},
+			{directoryBucket, UnknownDir},
+		} {
+			ib, err := openInfo(tx, true, names...)
+			if err != nil {
+				return err
+			}
+
+			for _, cmd := range cmds {
+				ci := cmd.Info
+				if prev := ib.get(cmd.Name); prev != nil {
+					ci = mergeInfo(prev, ci)
+				}
+
+				err = ib.put(cmd.Name, ci)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package r
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistory(t *testing.T) {
+	modTime := time.Unix(1500000000, 0)
+	tests := []struct {
+		shell   string
+		history string
+		want    map[string]string
+		skipped int
+	}{
+		{
+			"bash",
+			"ls -la\n#1600000000\ngit status\n#1600000100\nls -la\n\n",
+			map[string]string{"ls -la": "2@1600000100", "git status": "1@1600000000"},
+			0,
+		},
+		{
+			"zsh",
+			": 1600000000:0;ls -la\n: 1600000200:3;echo one\\\ntwo\nplain\n: 1600000100:0;ls -la\n",
+			map[string]string{"ls -la": "2@1600000100", "plain": "1@1500000000"},
+			1,
+		},
+		{
+			"zsh",
+			": 1600000000:0;echo caf\xc3\x83\x89\n",
+			map[string]string{"echo caf\xc3\xa9": "1@1600000000"},
+			0,
+		},
+		{
+			"fish",
+			"- cmd: git status\n  when: 1600000000\n- cmd: echo a\\\\b\n  when: 1600000050\n  paths:\n    - a\n- cmd: git status\n  when: 1600000100\n- cmd: echo one\\ntwo\n  when: 1600000200\n",
+			map[string]string{"git status": "2@1600000100", "echo a\\b": "1@1600000050"},
+			1,
+		},
+	}
+
+	for _, test := range tests {
+		cmds, skipped, err := ParseHistory(test.shell, strings.NewReader(test.history), modTime)
+		if err != nil {
+			t.Fatal(test.shell, err)
+		}
+		if skipped != test.skipped {
+			t.Errorf("%s: %d multi-line commands should be skipped, got %d", test.shell, test.skipped, skipped)
+		}
+
+		got := make(map[string]string)
+		for _, cmd := range cmds {
+			got[cmd.Name] = fmt.Sprintf("%d@%d", cmd.Info.Count, cmd.Info.Time.Unix())
+		}
+
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.shell, got, test.want)
+			continue
+		}
+		for name, want := range test.want {
+			if got[name] != want {
+				t.Errorf("%s: %q should be %s, got %s", test.shell, name, want, got[name])
+			}
+		}
+	}
+
+	if _, _, err := ParseHistory("tcsh", strings.NewReader(""), modTime); err == nil {
+		t.Error("unknown shell should fail")
+	}
+}
+
+func TestImport(t *testing.T) {
+	s := new(Session)
+	s.Store = NewMemoryStore()
+
+	cmds, _, err := ParseHistory("bash", strings.NewReader("#1600000000\nls -la\nnotacommand --flag\nls -la\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		n, err := s.Import(cmds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Error("only commands in $PATH should be imported, got", n)
+		}
+	}
+
+	for _, results := range [][]*Command{
+		mustResults(t)(s.ResultsGlobal()),
+		mustResults(t)(s.ResultsDirectory(UnknownDir)),
+	} {
+		if len(results) != 1 || results[0].Info.Count != 2 {
+			t.Error("importing twice should keep the count of the file, got", results)
+		}
+	}
+
+	// Imported commands aren't pruned past the history limits
+	s.env = map[string]string{"R_DIRHISTORY": "1", "R_GLOBALHISTORY": "1"}
+	cmds, _, err = ParseHistory("bash", strings.NewReader("ls\nls -a\nls -l\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Import(cmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results := mustResults(t)(s.ResultsGlobal()); len(results) != 4 {
+		t.Error("every imported command should be kept, got", namesOfCmds(results))
+	}
+
+	// Ignored commands aren't imported
+	s.env["R_IGNORE"] = "ls -l*"
+	cmds, _, err = ParseHistory("bash", strings.NewReader("ls -lh\nls -R\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.Import(cmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Error("only the command that isn't ignored should be imported, got", n)
+	}
+	for _, cmd := range mustResults(t)(s.ResultsGlobal()) {
+		if cmd.Name == "ls -lh" {
+			t.Error("an ignored command shouldn't be imported")
+		}
+	}
+}
+
+// mustResults fails the test when a Results method returns an error
+func mustResults(t *testing.T) func([]*Command, error) []*Command {
+	return func(results []*Command, err error) []*Command {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+}
@@ -0,0 +1,155 @@
+package r
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// globRegexp returns the regular expression of a glob pattern. * and ?
+// match any character but / when dirs is set, where ** matches any
+// number of directories and dir/** matches dir and everything below it
+func globRegexp(pattern string, dirs bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '/' && dirs && strings.HasPrefix(pattern[i:], "/**"):
+			// dir/** matches dir too
+			b.WriteString("(/.*)?")
+			i += 2
+		case c == '*' && dirs && strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*' && dirs:
+			b.WriteString("[^/]*")
+		case c == '*':
+			b.WriteString(".*")
+		case c == '?' && dirs:
+			b.WriteString("[^/]")
+		case c == '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
+
+// ignoreRules returns the Session's Ignore rules or the ones in
+// R_IGNORE, one per line. A rule is a glob matching the whole command
+// or a regular expression after "re:"
+func (s *Session) ignoreRules() ([]*regexp.Regexp, error) {
+	rules := s.Ignore
+	if len(rules) == 0 {
+		rules = strings.Split(s.getenv("R_IGNORE"), "\n")
+	}
+
+	var res []*regexp.Regexp
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		var re *regexp.Regexp
+		var err error
+		if strings.HasPrefix(rule, "re:") {
+			re, err = regexp.Compile(strings.TrimPrefix(rule, "re:"))
+		} else {
+			re, err = globRegexp(rule, false)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ignore rule %q: %s", rule, err)
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// ignoreDirs returns the Session's IgnoreDirs or the colon separated
+// list in R_IGNOREDIRS. A leading ~ is the home directory
+func (s *Session) ignoreDirs() ([]*regexp.Regexp, error) {
+	dirs := s.IgnoreDirs
+	if len(dirs) == 0 {
+		if env := s.getenv("R_IGNOREDIRS"); env != "" {
+			dirs = strings.Split(env, ":")
+		}
+	}
+
+	var res []*regexp.Regexp
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			dir = home + dir[1:]
+		}
+
+		re, err := globRegexp(filepath.Clean(dir), true)
+		if err != nil {
+			return nil, fmt.Errorf("ignored directory %q: %s", dir, err)
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// Ignored checks if promptCmd ran in dir shouldn't be recorded. Nothing
+// is recorded while R_PAUSED is set by r pause in the shell. Command
+// lines starting with a space are ignored like HISTCONTROL=ignorespace
+// does in bash. So are command lines with a command matching an ignore
+// rule and commands ran in an ignored directory
+func (s *Session) Ignored(dir string, promptCmd string) (bool, error) {
+	if s.getenv("R_PAUSED") != "" || strings.HasPrefix(promptCmd, " ") {
+		return true, nil
+	}
+
+	rules, err := s.ignoreRules()
+	if err != nil {
+		return false, err
+	}
+
+	// Rules match the whole line or any of its commands
+	texts := []string{promptCmd}
+	if line, err := ParseCommandLine(promptCmd); err == nil {
+		for _, c := range line.Commands {
+			texts = append(texts, promptCmd[c.Start:c.End])
+		}
+	}
+
+	for _, re := range rules {
+		for _, text := range texts {
+			if re.MatchString(text) {
+				return true, nil
+			}
+		}
+	}
+
+	dirs, err := s.ignoreDirs()
+	if err != nil {
+		return false, err
+	}
+
+	dir = filepath.Clean(dir)
+	for _, re := range dirs {
+		if re.MatchString(dir) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,76 @@
+package r
+
+import (
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	for _, test := range []struct {
+		pattern, s string
+		dirs, match bool
+	}{
+		{"ls *", "ls -la", false, true},
+		{"ls *", "ls", false, false},
+		{"* --password *", "mysql --password x", false, true},
+		{"cd ?", "cd -", false, true},
+		{"a.b", "axb", false, false},
+		{"/tmp/*", "/tmp/dir", true, true},
+		{"/tmp/*", "/tmp/dir/sub", true, false},
+		{"/tmp/**", "/tmp", true, true},
+		{"/tmp/**", "/tmp/dir/sub", true, true},
+		{"/tmp/**", "/tmpdir", true, false},
+		{"/**/secrets", "/home/me/secrets", true, true},
+	} {
+		re, err := globRegexp(test.pattern, test.dirs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if re.MatchString(test.s) != test.match {
+			t.Errorf("%q matching %q should be %v", test.pattern, test.s, test.match)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	s := new(Session)
+	s.env = map[string]string{
+		"R_IGNORE":     "history*\nre:^vault ",
+		"R_IGNOREDIRS": "/tmp/secrets/**:/home/*/private",
+	}
+
+	for _, test := range []struct {
+		dir, cmd string
+		ignored  bool
+	}{
+		{"/tmp", "ls", false},
+		{"/tmp", " ls", true},
+		{"/tmp", "history -c", true},
+		{"/tmp", "vault read secret", true},
+		{"/tmp", "echo vault read", false},
+		{"/tmp", "cd /tmp && history -c", true},
+		{"/tmp", "echo 'a && history'", false},
+		{"/tmp/secrets", "ls", true},
+		{"/tmp/secrets/sub/", "ls", true},
+		{"/home/me/private", "ls", true},
+		{"/home/me/private/sub", "ls", false},
+	} {
+		ignored, err := s.Ignored(test.dir, test.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ignored != test.ignored {
+			t.Errorf("%q in %s ignored should be %v", test.cmd, test.dir, test.ignored)
+		}
+	}
+
+	s.env["R_PAUSED"] = "1"
+	if ignored, _ := s.Ignored("/tmp", "ls"); !ignored {
+		t.Error("nothing should be recorded while paused")
+	}
+	delete(s.env, "R_PAUSED")
+
+	s.Ignore = []string{"re:("}
+	if _, err := s.Ignored("/tmp", "ls"); err == nil {
+		t.Error("an invalid rule should fail")
+	}
+}
@@ -0,0 +1,340 @@
+package r
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	timeIndexBucket  = "TimeIndexBucket"  // BoltDB bucket indexing the command info buckets by last used time
+	countIndexBucket = "CountIndexBucket" // BoltDB bucket indexing the command info buckets by use count
+)
+
+// putUint64 appends n to key in big-endian so keys sort by n.
+// Negative numbers sort as 0
+func putUint64(key []byte, n int64) []byte {
+	if n < 0 {
+		n = 0
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	return append(key, buf[:]...)
+}
+
+// timeKey returns the time index key of name last used at t. Keys start
+// with the big-endian Unix time so a cursor walks them oldest first
+func timeKey(t time.Time, name string) []byte {
+	key := putUint64(make([]byte, 0, 8+len(name)), t.Unix())
+	return append(key, name...)
+}
+
+// countKey returns the count index key of name used count times, last at
+// t. Keys start with the big-endian count then the time so a cursor walks
+// them least used first and commands used as often oldest first
+func countKey(count int, t time.Time, name string) []byte {
+	key := putUint64(make([]byte, 0, 16+len(name)), int64(count))
+	key = putUint64(key, t.Unix())
+	return append(key, name...)
+}
+
+// infoBucket is a bucket of command info values with its indexes
+type infoBucket struct {
+	b       Bucket
+	byTime  Bucket
+	byCount Bucket
+}
+
+// openInfo returns the command info bucket at the path of nested bucket
+// names and its indexes, which are created when tx is writable. When
+// create is false it returns nil if the bucket doesn't exist
+func openInfo(tx Tx, create bool, names ...string) (*infoBucket, error) {
+	var b Bucket
+	var err error
+	if create {
+		b, err = createBuckets(tx, names)
+		if err != nil {
+			return nil, err
+		}
+	} else if b = findBuckets(tx, names); b == nil {
+		return nil, nil
+	}
+
+	ib := &infoBucket{b: b}
+	ib.byTime, err = openIndex(tx, timeIndexBucket, names)
+	if err != nil {
+		return nil, err
+	}
+
+	ib.byCount, err = openIndex(tx, countIndexBucket, names)
+	if err != nil {
+		return nil, err
+	}
+
+	return ib, nil
+}
+
+// openIndex returns the index of the command info bucket at names
+// kept in the index bucket, creating it when tx is writable
+func openIndex(tx Tx, index string, names []string) (Bucket, error) {
+	path := append([]string{index}, names...)
+	if b := findBuckets(tx, path); b != nil || !tx.Writable() {
+		return b, nil
+	}
+
+	return createBuckets(tx, path)
+}
+
+// findBuckets returns the nested bucket at names or nil
+func findBuckets(tx Tx, names []string) Bucket {
+	b := tx.Bucket([]byte(names[0]))
+	for _, name := range names[1:] {
+		if b == nil {
+			return nil
+		}
+		b = b.Bucket([]byte(name))
+	}
+
+	return b
+}
+
+// createBuckets returns the nested bucket at names creating what's missing
+func createBuckets(tx Tx, names []string) (Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(names[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names[1:] {
+		b, err = b.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// get returns the info of name or nil when it isn't stored
+func (ib *infoBucket) get(name string) *CommandInfo {
+	v := ib.b.Get([]byte(name))
+	if v == nil {
+		return nil
+	}
+
+	return new(CommandInfo).NewFromString(string(v))
+}
+
+// put stores ci for name and moves name to its place in the indexes
+func (ib *infoBucket) put(name string, ci *CommandInfo) error {
+	err := ib.unindex(name)
+	if err != nil {
+		return err
+	}
+
+	err = ib.b.Put([]byte(name), []byte(ci.String()))
+	if err != nil {
+		return err
+	}
+
+	err = ib.byTime.Put(timeKey(ci.Time, name), []byte{})
+	if err != nil {
+		return err
+	}
+
+	return ib.byCount.Put(countKey(ci.Count, ci.Time, name), []byte{})
+}
+
+// delete removes name from the bucket and the indexes
+func (ib *infoBucket) delete(name string) error {
+	err := ib.unindex(name)
+	if err != nil {
+		return err
+	}
+
+	return ib.b.Delete([]byte(name))
+}
+
+// unindex removes the index keys of the stored info of name
+func (ib *infoBucket) unindex(name string) error {
+	prev := ib.get(name)
+	if prev == nil {
+		return nil
+	}
+
+	err := ib.byTime.Delete(timeKey(prev.Time, name))
+	if err != nil {
+		return err
+	}
+
+	return ib.byCount.Delete(countKey(prev.Count, prev.Time, name))
+}
+
+// index returns the index ordered like the sort mode
+// and the length of the key before the command name
+func (ib *infoBucket) index(mode int) (Bucket, int) {
+	if mode == sortUsage {
+		return ib.byCount, 16
+	}
+
+	return ib.byTime, 8
+}
+
+// prune deletes the commands past limit, the least used ones when mode
+// is sortUsage and the least recently used ones otherwise, and returns
+// them. Only the pruned keys of the index are read
+func (ib *infoBucket) prune(limit int, mode int) ([]*Command, error) {
+	index, prefix := ib.index(mode)
+
+	var pruned []*Command
+	c := index.Cursor()
+	k, _ := c.Last()
+	for i := 0; k != nil && i < limit; i++ {
+		k, _ = c.Prev()
+	}
+	for ; k != nil; k, _ = c.Prev() {
+		if len(k) <= prefix {
+			continue
+		}
+
+		name := string(k[prefix:])
+		if ci := ib.get(name); ci != nil {
+			pruned = append(pruned, &Command{Name: name, Info: ci})
+		}
+	}
+
+	// Bolt doesn't allow changing a bucket while iterating it
+	for _, cmd := range pruned {
+		err := ib.delete(cmd.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pruned, nil
+}
+
+// readInfo returns the commands of the command info bucket at names in
+// sort order, keeping those matching the Failed and All flags up to
+// Limit. Sorting by time or usage walks the matching index from the end
+// and stops at Limit. Sorting by frecency reads the whole bucket and
+// scores the runs keep keeps
+func (s *Session) readInfo(tx Tx, keep func(*Run) bool, names ...string) ([]*Command, error) {
+	ib, err := openInfo(tx, false, names...)
+	if err != nil || ib == nil {
+		return nil, err
+	}
+
+	mode := s.sortMode()
+	index, prefix := ib.index(mode)
+	if mode == sortFrecency || index == nil {
+		var results []*Command
+		err := ib.b.ForEach(func(k, v []byte) error {
+			if v == nil || string(k) == hookArtifact {
+				return nil
+			}
+
+			results = append(results, &Command{
+				Name: string(k),
+				Info: new(CommandInfo).NewFromString(string(v)),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.scoreFrecency(tx, results, keep)
+		if err != nil {
+			return nil, err
+		}
+
+		s.sortCommands(results)
+		return s.limitCommands(s.filterCommands(results)), nil
+	}
+
+	var results []*Command
+	c := index.Cursor()
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		if s.Limit > 0 && len(results) == s.Limit {
+			break
+		}
+		if len(k) <= prefix {
+			continue
+		}
+
+		name := k[prefix:]
+		v := ib.b.Get(name)
+		if v == nil || string(name) == hookArtifact {
+			continue
+		}
+
+		cmd := &Command{
+			Name: string(name),
+			Info: new(CommandInfo).NewFromString(string(v)),
+		}
+		if s.All || cmd.Info.Failed() == s.Failed {
+			results = append(results, cmd)
+		}
+	}
+
+	return results, nil
+}
+
+// limitCommands keeps the first Limit results
+func (s *Session) limitCommands(results []*Command) []*Command {
+	if s.Limit > 0 && len(results) > s.Limit {
+		return results[:s.Limit]
+	}
+
+	return results
+}
+
+// forEachInfo calls fn with every command info value of every command
+// info bucket and returns how many there are
+func forEachInfo(tx Tx, fn func(ib *infoBucket, name string, ci *CommandInfo) error) (int, error) {
+	count := 0
+	err := forEachInfoBucket(tx, func(names []string, b Bucket) error {
+		ib, err := openInfo(tx, false, names...)
+		if err != nil {
+			return err
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+
+			count++
+			return fn(ib, string(k), new(CommandInfo).NewFromString(string(v)))
+		})
+	})
+
+	return count, err
+}
+
+// migrateTimeIndex indexes every command info bucket by last used time
+func migrateTimeIndex(tx Tx, report func(format string, a ...interface{})) error {
+	count, err := forEachInfo(tx, func(ib *infoBucket, name string, ci *CommandInfo) error {
+		return ib.byTime.Put(timeKey(ci.Time, name), []byte{})
+	})
+	if err != nil {
+		return err
+	}
+
+	report("index %d command info values by last used time", count)
+	return nil
+}
+
+// migrateCountIndex indexes every command info bucket by use count
+func migrateCountIndex(tx Tx, report func(format string, a ...interface{})) error {
+	count, err := forEachInfo(tx, func(ib *infoBucket, name string, ci *CommandInfo) error {
+		return ib.byCount.Put(countKey(ci.Count, ci.Time, name), []byte{})
+	})
+	if err != nil {
+		return err
+	}
+
+	report("index %d command info values by use count", count)
+	return nil
+}
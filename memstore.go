@@ -0,0 +1,270 @@
+package r
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Errors returned by the MemoryStore, matching the ones Bolt returns
+var (
+	errTxNotWritable    = errors.New("tx not writable")
+	errBucketNotFound   = errors.New("bucket not found")
+	errBucketNameEmpty  = errors.New("bucket name required")
+	errKeyRequired      = errors.New("key required")
+	errIncompatibleType = errors.New("incompatible value")
+)
+
+// MemoryStore is a Store kept in memory. It's meant for tests and for
+// tools that work on a copy of the history
+type MemoryStore struct {
+	mu   sync.RWMutex
+	root *memBucket
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{root: newMemBucket()}
+}
+
+// View runs fn on the current contents of the store
+func (s *MemoryStore) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memTx{root: s.root})
+}
+
+// Update runs fn on a copy of the store that replaces it when fn succeeds
+func (s *MemoryStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root := s.root.clone()
+	err := fn(&memTx{root: root, writable: true})
+	if err != nil {
+		return err
+	}
+
+	s.root = root
+	return nil
+}
+
+// Close does nothing, the contents stay available
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// memTx is a transaction of a MemoryStore
+type memTx struct {
+	root     *memBucket
+	writable bool
+}
+
+func (t *memTx) Bucket(name []byte) Bucket {
+	return t.root.bucket(t, name)
+}
+
+func (t *memTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return memBucketTx{t.root, t}.CreateBucketIfNotExists(name)
+}
+
+func (t *memTx) DeleteBucket(name []byte) error {
+	return memBucketTx{t.root, t}.DeleteBucket(name)
+}
+
+func (t *memTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	for _, k := range t.root.keys() {
+		b := t.root.buckets[k]
+		if b == nil {
+			continue
+		}
+
+		err := fn([]byte(k), memBucketTx{b, t})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memTx) Writable() bool {
+	return t.writable
+}
+
+// memBucket holds the values and nested buckets of a bucket. A key
+// is either a value or a bucket
+type memBucket struct {
+	values  map[string][]byte
+	buckets map[string]*memBucket
+}
+
+func newMemBucket() *memBucket {
+	return &memBucket{
+		values:  make(map[string][]byte),
+		buckets: make(map[string]*memBucket),
+	}
+}
+
+// clone deep copies the bucket. Values are never changed in place
+// so they are shared
+func (b *memBucket) clone() *memBucket {
+	c := newMemBucket()
+	for k, v := range b.values {
+		c.values[k] = v
+	}
+	for k, nested := range b.buckets {
+		c.buckets[k] = nested.clone()
+	}
+	return c
+}
+
+// keys returns every value and bucket key in order
+func (b *memBucket) keys() []string {
+	keys := make([]string, 0, len(b.values)+len(b.buckets))
+	for k := range b.values {
+		keys = append(keys, k)
+	}
+	for k := range b.buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *memBucket) bucket(tx *memTx, name []byte) Bucket {
+	nested := b.buckets[string(name)]
+	if nested == nil {
+		return nil
+	}
+	return memBucketTx{nested, tx}
+}
+
+// memBucketTx is a memBucket used in a transaction
+type memBucketTx struct {
+	b  *memBucket
+	tx *memTx
+}
+
+func (b memBucketTx) Get(key []byte) []byte {
+	return b.b.values[string(key)]
+}
+
+func (b memBucketTx) Put(key []byte, value []byte) error {
+	switch {
+	case !b.tx.writable:
+		return errTxNotWritable
+	case len(key) == 0:
+		return errKeyRequired
+	case b.b.buckets[string(key)] != nil:
+		return errIncompatibleType
+	}
+
+	// Callers may reuse the slice after Put
+	v := make([]byte, len(value))
+	copy(v, value)
+	b.b.values[string(key)] = v
+	return nil
+}
+
+func (b memBucketTx) Delete(key []byte) error {
+	switch {
+	case !b.tx.writable:
+		return errTxNotWritable
+	case b.b.buckets[string(key)] != nil:
+		return errIncompatibleType
+	}
+
+	delete(b.b.values, string(key))
+	return nil
+}
+
+func (b memBucketTx) Bucket(name []byte) Bucket {
+	return b.b.bucket(b.tx, name)
+}
+
+func (b memBucketTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	switch {
+	case !b.tx.writable:
+		return nil, errTxNotWritable
+	case len(name) == 0:
+		return nil, errBucketNameEmpty
+	case b.b.values[string(name)] != nil:
+		return nil, errIncompatibleType
+	}
+
+	nested := b.b.buckets[string(name)]
+	if nested == nil {
+		nested = newMemBucket()
+		b.b.buckets[string(name)] = nested
+	}
+
+	return memBucketTx{nested, b.tx}, nil
+}
+
+func (b memBucketTx) DeleteBucket(name []byte) error {
+	switch {
+	case !b.tx.writable:
+		return errTxNotWritable
+	case b.b.buckets[string(name)] == nil:
+		return errBucketNotFound
+	}
+
+	delete(b.b.buckets, string(name))
+	return nil
+}
+
+func (b memBucketTx) ForEach(fn func(k, v []byte) error) error {
+	for _, k := range b.b.keys() {
+		err := fn([]byte(k), b.b.values[k])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b memBucketTx) Cursor() Cursor {
+	return &memCursor{b: b.b, keys: b.b.keys(), i: -1}
+}
+
+// memCursor iterates the keys a bucket had when the cursor was created
+type memCursor struct {
+	b    *memBucket
+	keys []string
+	i    int
+}
+
+// at returns the key and value at index i
+func (c *memCursor) at(i int) ([]byte, []byte) {
+	if i < 0 || i >= len(c.keys) {
+		c.i = len(c.keys)
+		return nil, nil
+	}
+
+	c.i = i
+	k := c.keys[i]
+	return []byte(k), c.b.values[k]
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Last() ([]byte, []byte) {
+	return c.at(len(c.keys) - 1)
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(sort.SearchStrings(c.keys, string(seek)))
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	return c.at(c.i + 1)
+}
+
+func (c *memCursor) Prev() ([]byte, []byte) {
+	return c.at(c.i - 1)
+}
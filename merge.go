@@ -0,0 +1,112 @@
+package r
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rewrite replaces the From prefix of a directory with To
+type Rewrite struct {
+	From string
+	To   string
+}
+
+// ParseRewrite parses a "from=to" rewrite, ex. "/Users/me=/home/me"
+func ParseRewrite(s string) (Rewrite, error) {
+	pair := strings.SplitN(s, "=", 2)
+	if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+		return Rewrite{}, errors.New("rewrite should be in from=to format, ex. /Users/me=/home/me")
+	}
+
+	return Rewrite{From: filepath.Clean(pair[0]), To: filepath.Clean(pair[1])}, nil
+}
+
+// rewriteDir applies the first rewrite whose From is dir or one of
+// its parent directories
+func rewriteDir(dir string, rewrites []Rewrite) string {
+	for _, rw := range rewrites {
+		if dir == rw.From {
+			return rw.To
+		}
+
+		prefix := rw.From
+		if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+			prefix += string(filepath.Separator)
+		}
+		if strings.HasPrefix(dir, prefix) {
+			return filepath.Join(rw.To, strings.TrimPrefix(dir, prefix))
+		}
+	}
+
+	return dir
+}
+
+// Merge folds the r database at path, ex. a copy of the one of another
+// machine, into this one. The other database isn't changed. Commands
+// stored in both have their counts added up and keep the latest use, so
+// merging the same database twice counts its commands twice. Directories
+// are rewritten by the first matching rewrite. The history is pruned
+// afterwards. It returns how many records were merged
+func (s *Session) Merge(path string, rewrites []Rewrite) (int, error) {
+	if s.Store == nil && sameFile(path, s.BoltPath) {
+		return 0, errors.New("can't merge a database into itself")
+	}
+
+	bolt, err := openBoltStore(path, true)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := s.unseal(bolt)
+	if err != nil {
+		bolt.Close()
+		return 0, err
+	}
+
+	// Upgrade a copy so an older database can be read without writing to it
+	other := new(Session)
+	other.Store = NewMemoryStore()
+	err = copyStore(other.Store, src)
+	src.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	records, err := other.Records()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, rec := range records {
+		if rec.Dir != "" {
+			rec.Dir = rewriteDir(rec.Dir, rewrites)
+		}
+		if rec.Run != nil && rec.Run.Dir != "" {
+			rec.Run.Dir = rewriteDir(rec.Run.Dir, rewrites)
+		}
+	}
+
+	err = s.ImportRecords(records, MergeSum)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(records), nil
+}
+
+// sameFile checks if both paths are the same existing file
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(ai, bi)
+}
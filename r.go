@@ -3,15 +3,11 @@ package r
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 const (
@@ -33,17 +29,84 @@ type Session struct {
 	SortUsage bool
 	// SortTimePtr used to check if the time flag was used
 	SortTime bool
+	// SortFrecency used to check if the frecency flag was used
+	SortFrecency bool
+	// HalfLife is how long it takes a run to count half as much when
+	// sorting by frecency. Zero uses R_FRECENCY_HALFLIFE or a week
+	HalfLife time.Duration
+	// Failed shows only commands whose last run failed
+	Failed bool
+	// All shows commands whatever the exit status of their last run.
+	// By default only commands whose last run succeeded are shown
+	All bool
+	// Tree merges the history of parent directories up to the project root
+	Tree bool
+	// Descendants also merges the history of child directories with Tree
+	Descendants bool
+	// RootMarkers are file names marking the project root. Empty uses
+	// R_ROOTMARKERS or .git, .hg and .svn
+	RootMarkers []string
+	// Repo shows the history of the git repository from every
+	// clone and worktree of it
+	Repo bool
+	// ShellCommands are the aliases, functions and builtins of the shell
+	// that are recorded on top of the executables in $PATH. Empty uses
+	// R_SHELL_COMMANDS, separated by white space
+	ShellCommands []string
+	// Ignore are rules matching commands that aren't recorded, globs or
+	// regular expressions after "re:". Empty uses R_IGNORE, one per line
+	Ignore []string
+	// IgnoreDirs are globs matching directories whose commands aren't
+	// recorded, ex. ~/secrets/**. Empty uses the colon separated list in
+	// R_IGNOREDIRS
+	IgnoreDirs []string
+	// RedactPatterns are regular expressions matching secrets on top of
+	// the default ones. The first group of a pattern is what's masked.
+	// Empty uses the patterns in R_REDACT, one per line
+	RedactPatterns []string
+	// RedactMode is what's done with commands that have a secret,
+	// RedactMask or RedactSkip. Empty uses R_REDACT_MODE or RedactMask
+	RedactMode string
+	// Limit is the most commands the Results methods return.
+	// Zero returns every command
+	Limit int
+	// Socket is the path of the r daemon's Unix socket. When a daemon
+	// listens on it the Session sends its requests there
+	Socket string
+	// Store holds the history. When it's nil every call opens the
+	// Bolt database at BoltPath and closes it again
+	Store Store `json:"-"`
+	// Unlock returns the Cipher of an encrypted database from the params
+	// it was encrypted with. Without it an encrypted database can't be
+	// opened
+	Unlock func(params []byte) (Cipher, error) `json:"-"`
+
+	// env holds the R_ environment variables of a Session
+	// the daemon answers for
+	env map[string]string
+}
+
+// getenv returns the value of an R_ environment variable of the Session
+func (s *Session) getenv(key string) string {
+	if s.env != nil {
+		return s.env[key]
+	}
+
+	return os.Getenv(key)
 }
 
 // ResetLastCommand clears the value in the lastCommandBucket
 func (s *Session) ResetLastCommand() error {
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if _, ok, err := s.remote(&request{Op: "reset-last"}); ok {
+		return err
+	}
+
+	db, err := s.open()
 	if err != nil {
-		fmt.Println("error resetLastCommand")
 		return err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(lastCommandBucket))
 		if err != nil {
 			return err
@@ -56,7 +119,7 @@ func (s *Session) ResetLastCommand() error {
 		return nil
 	})
 
-	db.Close()
+	s.close(db)
 
 	if err != nil {
 		return err
@@ -68,32 +131,45 @@ func (s *Session) ResetLastCommand() error {
 // CheckForHistory makes sure a directory has history or if the global bool is true
 // it will make sure the global bucket has a history
 func (s *Session) CheckForHistory() error {
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	wd, err := os.Getwd()
+	if err != nil {
+		return errors.New("Current directory doesn't have a history. Execute commands to build one")
+	}
+
+	if _, ok, err := s.remote(&request{Op: "check", Path: wd}); ok {
+		return err
+	}
+
+	return s.checkForHistory(wd)
+}
+
+// checkForHistory checks the history of the wd directory
+func (s *Session) checkForHistory(wd string) error {
+	db, err := s.open()
 	if err != nil {
-		fmt.Println("error checkForHistory")
 		return err
 	}
 
 	// Check if global bucket is empty. if it is return
-	err = db.View(func(tx *bolt.Tx) error {
+	err = db.View(func(tx Tx) error {
 		b := tx.Bucket([]byte(globalCommandBucket))
 		if b == nil {
-			return errors.New("r doesn't have a history. Execute commands to build one")
+			return errors.New("r doesn't have a history. Execute commands to build one or import your shell history with r import -from bash|zsh|fish")
 		}
 
 		// Check if current wording directy has a history
 		// if it doesn't return
 		if !s.Global {
-			wd, err := os.Getwd()
-			if err != nil {
-				return errors.New("Current directory doesn't have a history. Execute commands to build one")
-			}
-
 			b = tx.Bucket([]byte(directoryBucket))
 			if b == nil {
 				return errors.New("Current directory doesn't have a history. Execute commands to build one")
 			}
 
+			// Parent or child directories or the repository may have a history
+			if s.Tree || s.Repo {
+				return nil
+			}
+
 			pathBucket := b.Bucket([]byte(wd))
 			if pathBucket == nil {
 				return errors.New("Current directory doesn't have a history. Execute commands to build one")
@@ -103,7 +179,7 @@ func (s *Session) CheckForHistory() error {
 		return nil
 	})
 
-	db.Close()
+	s.close(db)
 
 	if err != nil {
 		return err
@@ -114,14 +190,17 @@ func (s *Session) CheckForHistory() error {
 
 // StoreLastCommand takes the line string and stores it
 func (s *Session) StoreLastCommand(line string) error {
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if _, ok, err := s.remote(&request{Op: "store-last", Command: line}); ok {
+		return err
+	}
+
+	db, err := s.open()
 	if err != nil {
-		fmt.Println("error storeLastCommand")
 		return err
 	}
 
 	// Set line as stored command
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(lastCommandBucket))
 		if err != nil {
 			return err
@@ -134,7 +213,7 @@ func (s *Session) StoreLastCommand(line string) error {
 		return nil
 	})
 
-	db.Close()
+	s.close(db)
 
 	if err != nil {
 		return err
@@ -146,14 +225,31 @@ func (s *Session) StoreLastCommand(line string) error {
 // PrintLastCommand is used with the r cli --command flag
 // it shows the last command selected from the readline prompt
 func (s *Session) PrintLastCommand() error {
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	val, err := s.LastCommand()
 	if err != nil {
-		fmt.Println("error printLastCommand")
 		return err
 	}
 
+	fmt.Println(val)
+	return nil
+}
+
+// LastCommand returns the last command selected from the prompt
+func (s *Session) LastCommand() (string, error) {
+	if resp, ok, err := s.remote(&request{Op: "last"}); ok {
+		if err != nil {
+			return "", err
+		}
+		return resp.Line, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return "", err
+	}
+
 	var val string
-	err = db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx Tx) error {
 		b, err := tx.CreateBucketIfNotExists([]byte(lastCommandBucket))
 		if err != nil {
 			return err
@@ -163,297 +259,311 @@ func (s *Session) PrintLastCommand() error {
 		return nil
 	})
 
-	db.Close()
+	s.close(db)
 
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	fmt.Println(val)
-	return nil
+	return val, nil
+}
+
+// sortMode returns how commands are sorted. A sort flag wins over
+// the default set by the environment variables
+func (s *Session) sortMode() int {
+	switch {
+	case s.SortFrecency:
+		return sortFrecency
+	case s.SortUsage:
+		return sortUsage
+	case s.SortTime:
+		return sortTime
+	}
+
+	// Check for environment variables for the default sorting
+	if s.getenv("R_SORTBYFRECENCY") == "1" {
+		return sortFrecency
+	}
+	if s.getenv("R_SORTBYUSAGE") == "1" {
+		return sortUsage
+	}
+
+	return sortTime
 }
 
 func (s *Session) sortCommands(results []*Command) {
-	// Check for environment variable for usage sorting
-	if os.Getenv("R_SORTBYUSAGE") == "1" {
-		if !s.SortTime {
-			sort.Sort(byUsage(results))
-		} else {
-			sort.Sort(byTime(results))
-		}
-		return
+	switch s.sortMode() {
+	case sortFrecency:
+		sort.Stable(byFrecency(results))
+	case sortUsage:
+		sort.Stable(byUsage(results))
+	default:
+		sort.Stable(byTime(results))
+	}
+}
+
+// sameRank checks if the sort mode ranks both commands the same
+func (s *Session) sameRank(a, b *Command) bool {
+	if a.Distance != b.Distance {
+		return false
+	}
+
+	switch s.sortMode() {
+	case sortFrecency:
+		return a.Frecency == b.Frecency
+	case sortUsage:
+		return a.Info.Count == b.Info.Count
 	}
 
-	// Check for usage flag
-	if !s.SortUsage {
-		sort.Sort(byTime(results))
-	} else {
-		sort.Sort(byUsage(results))
+	return a.Info.Time.Equal(b.Info.Time)
+}
+
+// filterCommands keeps the results matching the Failed and All flags
+func (s *Session) filterCommands(results []*Command) []*Command {
+	if s.All {
+		return results
+	}
+
+	var filtered []*Command
+	for _, cmd := range results {
+		if cmd.Info.Failed() == s.Failed {
+			filtered = append(filtered, cmd)
+		}
 	}
+
+	return filtered
 }
 
 // ResultsDirectory reads the boltdb and returns the command history
 // based on your current working directory
 func (s *Session) ResultsDirectory(path string) ([]*Command, error) {
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if resp, ok, err := s.remote(&request{Op: "results-directory", Path: path}); ok {
+		return resp.commands(err)
+	}
+
+	db, err := s.open()
 	if err != nil {
-		fmt.Println("error results")
 		return nil, err
 	}
 
 	var results []*Command
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(directoryBucket))
-		pathBucket := b.Bucket([]byte(path))
-		return pathBucket.ForEach(func(k, v []byte) error {
-			cmd := new(Command)
-			ci := new(CommandInfo)
-			cmd.Name = string(k)
-			cmd.Info = ci.NewFromString(string(v))
-
-			if cmd.Name == `[ "$LAST_CMD" = "r" ]` {
-				return nil
-			}
-
-			results = append(results, cmd)
-			return nil
-		})
+	err = db.View(func(tx Tx) error {
+		results, err = s.readInfo(tx, inDir(path), directoryBucket, path)
+		return err
 	})
 
-	db.Close()
+	s.close(db)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// Sort commands
-	s.sortCommands(results)
-
-	// Print results (Used for testing)
-	// for _, cmd := range results {
-	// 	fmt.Printf("%s: %s \n", cmd.name, cmd.info.count)
-	// }
+	for _, cmd := range results {
+		cmd.Dir = path
+	}
 
 	return results, nil
 }
 
 // ResultsGlobal returns all the results for the global commands bucket
 func (s *Session) ResultsGlobal() ([]*Command, error) {
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if resp, ok, err := s.remote(&request{Op: "results-global"}); ok {
+		return resp.commands(err)
+	}
+
+	db, err := s.open()
 	if err != nil {
-		fmt.Println("error globalResults")
 		return nil, err
 	}
 
-	// Now get all the commands stored
 	var results []*Command
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(globalCommandBucket))
-		err := b.ForEach(func(k, v []byte) error {
-			command := new(Command)
-			ci := new(CommandInfo)
-			command.Name = string(k)
-			command.Info = ci.NewFromString(string(v))
-			results = append(results, command)
-
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-
-		return nil
+	err = db.View(func(tx Tx) error {
+		results, err = s.readInfo(tx, nil, globalCommandBucket)
+		return err
 	})
 
-	db.Close()
+	s.close(db)
 
 	if err != nil {
 		return nil, err
 	}
 
-	// Sort commands
-	s.sortCommands(results)
+	return results, nil
+}
 
-	// Print results (Used for testing)
-	// for _, cmd := range results {
-	// 	fmt.Printf("%s: %s \n", cmd.name, cmd.info.time)
-	// }
+// Execution is a command line ran in a shell, as the hook records it
+type Execution struct {
+	Command  string        // The command line as typed
+	Dir      string        // Working directory of the command
+	Exit     int           // Exit status of the command
+	Duration time.Duration // How long the command took
+	Session  string        // tty or shell session the command ran in
+	// Start is when the command started. Zero is now minus Duration
+	Start time.Time
+}
 
-	return results, nil
+// Add checks if command being passed is in $PATH or the shell's
+// commands then stores the command, workding directory and exit status
+func (s *Session) Add(e *Execution) error {
+	start := e.Start
+	if start.IsZero() {
+		start = time.Now().Add(-e.Duration)
+	}
+
+	return s.AddRun(e.Command, &Run{
+		Start:    start,
+		Duration: e.Duration,
+		Exit:     e.Exit,
+		Session:  e.Session,
+		Dir:      e.Dir,
+	})
 }
 
-// Add checks if command being passed is in the listCommands
-// then stores the command and workding directory
-func (s *Session) Add(path string, promptCmd string) error {
-	// get the first command in the promptCmd string
-	cmd := strings.Split(promptCmd, " ")[0]
+// AddRun stores a single execution of promptCmd in the run log and
+// updates the command's global and directory aggregates from it.
+// A zero Start is set to now and an empty Hostname to this host
+func (s *Session) AddRun(promptCmd string, run *Run) error {
+	if run.Start.IsZero() {
+		run.Start = time.Now()
+	}
+	if run.Hostname == "" {
+		run.Hostname, _ = os.Hostname()
+	}
+
+	ignored, err := s.Ignored(run.Dir, promptCmd)
+	if err != nil || ignored {
+		return err
+	}
+
+	// Secrets are masked before the command leaves this process
+	promptCmd, _, err = s.Redact(promptCmd)
+	if err != nil || promptCmd == "" {
+		return err
+	}
+
+	// get the command the promptCmd string runs
+	promptCmd = strings.TrimSpace(promptCmd)
+	cmd := firstCommand(promptCmd)
 
 	// Don't store if the command is r
 	if cmd == "r" {
 		return nil
 	}
 
-	commands, err := listCommands()
+	executables, err := s.Executables(os.Getenv("PATH"), []string{cmd})
 	if err != nil {
-		fmt.Println("list commands?")
 		return err
 	}
 
 	// check if the command is valid
-	if !containsCmd(cmd, commands) {
+	if !s.knownCommand(run.Dir, cmd, executables) {
 		return nil
 	}
 
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		fmt.Println("error add")
+	// The command is checked against this process's $PATH
+	// before it's sent to the daemon
+	if _, ok, err := s.remote(&request{Op: "add", Command: promptCmd, Run: run}); ok {
 		return err
 	}
 
-	// Add command to db
-	err = db.Update(func(tx *bolt.Tx) error {
-		dBucket, err := tx.CreateBucketIfNotExists([]byte(directoryBucket))
-		if err != nil {
-			return err
-		}
+	return s.addRun(promptCmd, run)
+}
 
-		pathBucket, err := dBucket.CreateBucketIfNotExists([]byte(path))
-		if err != nil {
-			return err
-		}
+// addRun stores a run of a command that was already checked and prunes
+// the history in the same transaction
+func (s *Session) addRun(promptCmd string, run *Run) error {
+	path := run.Dir
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
 
-		// Store path and command for contextual path sorting
-		cmdBucket, err := tx.CreateBucketIfNotExists([]byte(globalCommandBucket))
+	// Commands in a git repository are also stored for the repository
+	run.Repo, err = repoID(db, path)
+	if err != nil {
+		s.close(db)
+		return err
+	}
+
+	// Add command to db
+	err = db.Update(func(tx Tx) error {
+		// Log the run then add it to the aggregates of every command
+		// info bucket it counts in
+		err = putRun(tx, promptCmd, run)
 		if err != nil {
 			return err
 		}
 
-		// Create commandInfo struct
-		ci := new(CommandInfo)
-		ci.Time = time.Now()
-		ci.Count = 1
-
-		// Check if there is a command info value already
-		v := cmdBucket.Get([]byte(promptCmd))
-		if v != nil {
-			// There is a previous command info value
-			// Let's update the count and time
-			ci.Update(string(v))
+		scopes := [][]string{
+			{globalCommandBucket},
+			{directoryBucket, path},
 		}
-
-		err = cmdBucket.Put([]byte(promptCmd), []byte(ci.String()))
-		if err != nil {
-			return err
+		if run.Repo != "" {
+			scopes = append(scopes, []string{repoBucket, run.Repo})
 		}
 
-		// Now let's do the same thing for the pathBucket
-		v = pathBucket.Get([]byte(promptCmd))
-		if v != nil {
-			// There is a previous command info value
-			// Let's update the count and time
-			ci.Update(string(v))
-		}
+		for _, names := range scopes {
+			ib, err := openInfo(tx, true, names...)
+			if err != nil {
+				return err
+			}
 
-		err = pathBucket.Put([]byte(promptCmd), []byte(ci.String()))
-		if err != nil {
-			return err
+			err = ib.put(promptCmd, addInfo(ib.get(promptCmd), run))
+			if err != nil {
+				return err
+			}
 		}
 
-		return nil
+		// now prune the older commands
+		return s.prune(tx, path, run.Repo)
 	})
 
-	db.Close()
+	s.close(db)
 
 	if err != nil {
 		return err
 	}
 
-	// now prune the older commands
-	err = s.Prune(path)
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
-// Prune deletes commands from a directory bucket and overall bucket
-func (s *Session) Prune(path string) error {
-	// Set number to prune from envar
-	numberToPruneDir, err := strconv.Atoi(os.Getenv("R_DIRHISTORY"))
+// HistoryLimits returns how many commands are kept for each directory and
+// repository and globally, from R_DIRHISTORY and R_GLOBALHISTORY
+func (s *Session) HistoryLimits() (int, int) {
+	dirLimit, err := strconv.Atoi(s.getenv("R_DIRHISTORY"))
 	if err != nil {
-		numberToPruneDir = 30
+		dirLimit = 30
 	}
 
-	numberToPruneGlobal, err := strconv.Atoi(os.Getenv("R_GLOBALHISTORY"))
+	globalLimit, err := strconv.Atoi(s.getenv("R_GLOBALHISTORY"))
 	if err != nil {
-		numberToPruneGlobal = 100
+		globalLimit = 100
 	}
 
-	pruneGlobal := true
-	prunePath := true
+	return dirLimit, globalLimit
+}
 
-	results, err := s.ResultsDirectory(path)
-	if err != nil {
+// Prune archives the least recently used commands, or the least used
+// ones when sorting by usage, past the history limits from the directory
+// bucket of path, its repository and the global bucket
+func (s *Session) Prune(path string) error {
+	if _, ok, err := s.remote(&request{Op: "prune", Path: path}); ok {
 		return err
 	}
 
-	if len(results) <= numberToPruneDir {
-		prunePath = false
-	}
-
-	// List the global commands
-	globalResults, err := s.ResultsGlobal()
+	db, err := s.open()
 	if err != nil {
 		return err
 	}
 
-	// set pruneGlobal to true if there isn't enough
-	if len(globalResults) <= numberToPruneGlobal {
-		pruneGlobal = false
-	}
-
-	db, err := bolt.Open(s.BoltPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		fmt.Println("error prune")
-		return err
+	repo, err := repoID(db, path)
+	if err == nil {
+		err = db.Update(func(tx Tx) error {
+			return s.prune(tx, path, repo)
+		})
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		if prunePath {
-			directoryBucket, err := tx.CreateBucketIfNotExists([]byte(directoryBucket))
-			if err != nil {
-				return err
-			}
-
-			pathBucket, err := directoryBucket.CreateBucketIfNotExists([]byte(path))
-			if err != nil {
-				return err
-			}
-
-			pruneDirResults := results[numberToPruneDir:]
-			for _, cmd := range pruneDirResults {
-				pathBucket.Delete([]byte(cmd.Name))
-			}
-		}
-		// Prune stored global commands
-		if pruneGlobal {
-			// Store path and command for contextual path sorting
-			cmdBucket, err := tx.CreateBucketIfNotExists([]byte(globalCommandBucket))
-			if err != nil {
-				return err
-			}
-
-			pruneGlobalResults := globalResults[numberToPruneGlobal:]
-			for _, cmd := range pruneGlobalResults {
-				cmdBucket.Delete([]byte(cmd.Name))
-			}
-		}
-
-		return nil
-	})
-
-	db.Close()
+	s.close(db)
 
 	if err != nil {
 		return err
@@ -462,85 +572,45 @@ func (s *Session) Prune(path string) error {
 	return nil
 }
 
-// namesOfCmds takes a slice of command structs and return
-// a slice with just their names
-func namesOfCmds(cmds []*Command) []string {
-	var names []string
-	for _, cmd := range cmds {
-		names = append(names, cmd.Name)
-	}
-
-	return names
-}
+// prune moves the commands past the history limits in tx to the archive
+func (s *Session) prune(tx Tx, path string, repo string) error {
+	dirLimit, globalLimit := s.HistoryLimits()
+	mode := s.sortMode()
 
-// containsCmd checks if a command string is is in a slice of strings
-func containsCmd(cmd string, commands []string) bool {
-	for _, c := range commands {
-		// check first command against list of commands
-		if c == cmd {
-			return true
-		}
+	err := pruneInfo(tx, dirLimit, mode, directoryBucket, path)
+	if err != nil {
+		return err
 	}
-	return false
-}
-
-// listCommands use $PATH to find directories
-// Then reads each directory and looks for executables
-func listCommands() ([]string, error) {
-	// Split $PATH directories into slice
-	paths := strings.Split(os.Getenv("PATH"), ":")
-	var commands []string
-
-	// created buffered error chan
-	errc := make(chan error, 1)
-	defer close(errc)
-
-	// sync go routines
-	var wg sync.WaitGroup
-
-	// find commands appends results to commands slice
-	findCommands := func(p string) {
-		defer wg.Done()
-
-		// First check to see if directory exist
-		if exists(p) == false {
-			errc <- nil
-			return
-		}
 
-		files, err := ioutil.ReadDir(p)
+	// Repositories are kept to the same size as directories
+	if repo != "" {
+		err = pruneInfo(tx, dirLimit, mode, repoBucket, repo)
 		if err != nil {
-			errc <- err // write err into error chan
-			return
-		}
-
-		for _, f := range files {
-			m := f.Mode()
-
-			// Check if file is executable
-			if m&0111 != 0 {
-				commands = append(commands, f.Name())
-			}
+			return err
 		}
-
-		errc <- nil // write nil into error chan
 	}
 
-	// Check each path for commands
-	for _, p := range paths {
-		wg.Add(1)
-
-		go findCommands(p)
+	return pruneInfo(tx, globalLimit, mode, globalCommandBucket)
+}
 
-		// read any error that is in error chan
-		if err := <-errc; err != nil {
-			return nil, err
-		}
+// pruneInfo moves the commands past limit from the command info bucket at
+// names to its archive. The runs of commands pruned from the global
+// bucket are deleted
+func pruneInfo(tx Tx, limit int, mode int, names ...string) error {
+	ib, err := openInfo(tx, false, names...)
+	if err != nil || ib == nil {
+		return err
 	}
 
-	wg.Wait() // Wait for the paths to be checked
+	pruned, err := ib.prune(limit, mode)
+	if err != nil {
+		return err
+	}
 
-	return commands, nil
+	if names[0] == globalCommandBucket {
+		return archiveGlobal(tx, pruned)
+	}
+	return archiveCommands(tx, pruned, names...)
 }
 
 func exists(path string) bool {
@@ -550,8 +620,3 @@ func exists(path string) bool {
 	}
 	return true
 }
-
-// stats TODO print stats and usage of r
-func stats() {
-	fmt.Println("stats")
-}
@@ -1,8 +1,12 @@
 package r
 
 import (
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,6 +15,16 @@ import (
 
 // const dbTestPath = "test.db"
 
+// namesOfCmds returns the names of cmds
+func namesOfCmds(cmds []*Command) []string {
+	var names []string
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name)
+	}
+
+	return names
+}
+
 type testDB struct {
 	*bolt.DB
 	TestPath string
@@ -94,7 +108,7 @@ func TestCheckForHistory(t *testing.T) {
 	s.Global = false
 
 	err = s.CheckForHistory()
-	if err.Error() != "r doesn't have a history. Execute commands to build one" {
+	if err.Error() != "r doesn't have a history. Execute commands to build one or import your shell history with r import -from bash|zsh|fish" {
 		t.Error("There shouldn't be a history")
 	}
 
@@ -142,3 +156,692 @@ func TestCheckForHistory(t *testing.T) {
 	db.Close()
 
 }
+
+func TestAddRun(t *testing.T) {
+	db := new(testDB)
+	db, err := db.New()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.Remove(db.TestPath)
+
+	// Test r Session
+	s := new(Session)
+	s.BoltPath = db.TestPath
+
+	first := &Run{Dir: "/tmp", Duration: time.Second, Exit: 0, Session: "tty1"}
+	err = s.AddRun("ls -la", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := &Run{Dir: "/tmp", Duration: 2 * time.Second, Session: "tty2"}
+	err = s.AddRun("ls -la", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runs, err := s.Runs("ls -la")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Fatal("there should be 2 runs, got", len(runs))
+	}
+
+	last, err := s.LastRun("ls -la")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Duration != 2*time.Second || last.Session != "tty2" {
+		t.Error("last run should be the second run, got", last)
+	}
+	if last.Hostname == "" {
+		t.Error("hostname should be set")
+	}
+
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Info.Count != 2 {
+		t.Error("count should be derived from the 2 runs")
+	}
+}
+
+func TestMaxRuns(t *testing.T) {
+	s := new(Session)
+	s.Store = NewMemoryStore()
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < maxRuns+5; i++ {
+		err := s.addRun("make", &Run{Start: start.Add(time.Duration(i) * time.Second), Dir: "/tmp", Exit: i % 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, err := s.Runs("make")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != maxRuns || !runs[0].Start.Equal(start.Add(5*time.Second)) {
+		t.Error("only the latest", maxRuns, "runs should be kept, got", len(runs))
+	}
+
+	// The aggregates still count every run
+	s.All = true
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Info.Count != maxRuns+5 || results[0].Info.Exit != (maxRuns+4)%2 {
+		t.Error("count should include the deleted runs, got", results)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := new(testDB)
+	db, err := db.New()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Build an unversioned database with a hook artifact and a broken value
+	err = db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(globalCommandBucket))
+		if err != nil {
+			return err
+		}
+		b.Put([]byte(hookArtifact), []byte("2017-01-02T15:04:05Z,1"))
+		b.Put([]byte("ls"), []byte("garbage"))
+		b.Put([]byte("pwd"), []byte("2017-01-02T15:04:05Z,3"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB.Close()
+
+	s := new(Session)
+	s.BoltPath = db.TestPath
+
+	changes, err := s.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 10 {
+		t.Error("dry run should report 10 changes, got", changes)
+	}
+
+	// The dry run shouldn't have written anything
+	changes, err = s.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 10 {
+		t.Error("migrate should report 10 changes, got", changes)
+	}
+
+	changes, err = s.Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Error("database should be up to date, got", changes)
+	}
+
+	err = db.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(btx *bolt.Tx) error {
+		tx := boltTx{btx}
+		version, err := readVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version != SchemaVersion() {
+			t.Error("schema version should be", SchemaVersion(), "got", version)
+		}
+
+		b := tx.Bucket([]byte(globalCommandBucket))
+		if b.Get([]byte(hookArtifact)) != nil {
+			t.Error("hook artifact should be removed")
+		}
+		if !validInfo(string(b.Get([]byte("ls")))) {
+			t.Error("broken value should be repaired")
+		}
+		if v := string(b.Get([]byte("pwd"))); v != "2017-01-02T15:04:05Z,3,0" {
+			t.Error("value should have an exit status, got", v)
+		}
+
+		pwd, _ := time.Parse(time.RFC3339, "2017-01-02T15:04:05Z")
+		index := tx.Bucket([]byte(timeIndexBucket)).Bucket([]byte(globalCommandBucket))
+		if index.Get(timeKey(pwd, "pwd")) == nil {
+			t.Error("pwd should be in the time index")
+		}
+		index = tx.Bucket([]byte(countIndexBucket)).Bucket([]byte(globalCommandBucket))
+		if index.Get(countKey(3, pwd, "pwd")) == nil {
+			t.Error("pwd should be in the count index")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	db.Close()
+}
+
+// racedStore migrates its Store right after the first read transaction,
+// like another process opening the database at the same time
+type racedStore struct {
+	Store
+	raced bool
+}
+
+func (s *racedStore) View(fn func(tx Tx) error) error {
+	err := s.Store.View(fn)
+	if err != nil || s.raced {
+		return err
+	}
+
+	s.raced = true
+	_, err = migrate(s.Store, false)
+	return err
+}
+
+func TestMigrateRace(t *testing.T) {
+	store := NewMemoryStore()
+	err := store.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(globalCommandBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("pwd"), []byte("2017-01-02T15:04:05Z,3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := migrate(&racedStore{Store: store}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Error("a database migrated by someone else shouldn't be migrated again, got", changes)
+	}
+}
+
+func TestFailedCommands(t *testing.T) {
+	db := new(testDB)
+	db, err := db.New()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.Remove(db.TestPath)
+
+	// Test r Session
+	s := new(Session)
+	s.BoltPath = db.TestPath
+
+	err = s.Add(&Execution{Command: "ls", Dir: "/tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(&Execution{Command: "ls missing", Dir: "/tmp", Exit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "ls" {
+		t.Error("only successful commands should be shown by default")
+	}
+
+	s.Failed = true
+	results, err = s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "ls missing" || results[0].Info.Exit != 2 {
+		t.Error("only the failed command should be shown")
+	}
+
+	s.All = true
+	results, err = s.ResultsGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Error("all commands should be shown, got", len(results))
+	}
+
+	// A successful run clears the failure
+	err = s.Add(&Execution{Command: "ls missing", Dir: "/tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.All = false
+	results, err = s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Error("there shouldn't be failed commands left, got", len(results))
+	}
+}
+
+func TestFrecency(t *testing.T) {
+	now := time.Now()
+	monthAgo := now.Add(-30 * 24 * time.Hour)
+
+	var old, recent []*Run
+	for i := 0; i < 10; i++ {
+		old = append(old, &Run{Start: monthAgo, Dir: "/tmp"})
+	}
+	for i := 0; i < 3; i++ {
+		recent = append(recent, &Run{Start: now, Dir: "/tmp"})
+	}
+
+	oldInfo := &CommandInfo{Time: monthAgo, Count: 10}
+	recentInfo := &CommandInfo{Time: now, Count: 3}
+
+	week := 7 * 24 * time.Hour
+	if frecency(oldInfo, old, nil, now, week) >= frecency(recentInfo, recent, nil, now, week) {
+		t.Error("recent runs should outrank old runs with a week half-life")
+	}
+
+	year := 365 * 24 * time.Hour
+	if frecency(oldInfo, old, nil, now, year) <= frecency(recentInfo, recent, nil, now, year) {
+		t.Error("more runs should outrank fewer runs with a year half-life")
+	}
+
+	// Uses from before the run log are counted at the last used time
+	legacy := frecency(&CommandInfo{Time: now, Count: 3}, nil, nil, now, week)
+	if legacy != 3 {
+		t.Error("legacy uses should count at the last used time, got", legacy)
+	}
+
+	// A directory's info only counts the runs in that directory, so every
+	// use is in the run log and the legacy fallback adds nothing
+	if score := frecency(recentInfo, recent, inDir("/tmp"), now, week); score != 3 {
+		t.Error("the runs in the directory should count, got", score)
+	}
+	if score := frecency(&CommandInfo{Time: now}, recent, inDir("/other"), now, week); score != 0 {
+		t.Error("runs in other directories shouldn't count, got", score)
+	}
+}
+
+func TestResultsTree(t *testing.T) {
+	db := new(testDB)
+	db, err := db.New()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.Remove(db.TestPath)
+
+	// Build a project with a .git root marker
+	parent, err := ioutil.TempDir("", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	root := filepath.Join(parent, "project")
+	sub := filepath.Join(root, "cmd", "r")
+	child := filepath.Join(sub, "internal")
+	err = os.MkdirAll(filepath.Join(root, ".git"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(Session)
+	s.BoltPath = db.TestPath
+
+	adds := []struct{ dir, cmd string }{
+		{parent, "ls outside"},
+		{root, "ls root"},
+		{root, "ls sub"},
+		{filepath.Join(root, "cmd"), "ls cmd"},
+		{sub, "ls sub"},
+		{child, "ls child"},
+	}
+	for _, add := range adds {
+		err = s.Add(&Execution{Command: add.cmd, Dir: add.dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Tree = true
+	results, err := s.ResultsTree(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"ls sub", "ls cmd", "ls root"}
+	if len(results) != len(want) {
+		t.Fatal("results should be", want, "got", namesOfCmds(results))
+	}
+	for i, cmd := range results {
+		if cmd.Name != want[i] || cmd.Distance != i {
+			t.Error("result", i, "should be", want[i], "got", cmd.Name, cmd.Distance)
+		}
+	}
+	if results[0].Dir != sub {
+		t.Error("ls sub should be labelled with the nearest directory, got", results[0].Dir)
+	}
+
+	s.Descendants = true
+	results, err = s.ResultsTree(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 {
+		t.Fatal("child directory history should be included, got", namesOfCmds(results))
+	}
+	for _, cmd := range results {
+		if cmd.Name == "ls child" && (cmd.Dir != child || cmd.Distance != 1) {
+			t.Error("ls child should be labelled with its directory, got", cmd.Dir, cmd.Distance)
+		}
+	}
+
+	// Ties between directories at the same distance keep their order
+	sibling := filepath.Join(sub, "testdata")
+	err = s.Add(&Execution{Command: "ls sibling", Dir: sibling})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SortUsage = true
+	first, err := s.ResultsTree(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		results, err = s.ResultsTree(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(namesOfCmds(results), "\n") != strings.Join(namesOfCmds(first), "\n") {
+			t.Fatal("results should keep the same order, expected", namesOfCmds(first), "got", namesOfCmds(results))
+		}
+	}
+	s.SortUsage = false
+	s.Descendants = false
+
+	// A failure in a nearer directory doesn't hide a success further up
+	err = s.Add(&Execution{Command: "make", Dir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Add(&Execution{Command: "make", Dir: sub, Exit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err = s.ResultsTree(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, cmd := range results {
+		if cmd.Name == "make" {
+			found = true
+			if cmd.Dir != root {
+				t.Error("make should come from the directory it succeeded in, got", cmd.Dir)
+			}
+		}
+	}
+	if !found {
+		t.Error("make succeeded in the project root and should be shown, got", namesOfCmds(results))
+	}
+
+	s.Failed = true
+	results, err = s.ResultsTree(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "make" || results[0].Dir != sub {
+		t.Error("make should only be shown failing in the current directory, got", namesOfCmds(results))
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	db := new(testDB)
+	db, err := db.New()
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.Remove(db.TestPath)
+
+	dir, err := ioutil.TempDir("", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "r.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	daemon := new(Session)
+	daemon.BoltPath = db.TestPath
+	done := make(chan error)
+	go func() {
+		done <- daemon.serve(l, 500*time.Millisecond)
+	}()
+
+	// The daemon holds the database lock so the client has to use the socket
+	s := new(Session)
+	s.BoltPath = db.TestPath
+	s.Socket = socket
+
+	err = s.Add(&Execution{Command: "ls -la", Dir: "/tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.StoreLastCommand("ls -la")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := s.LastCommand()
+	if err != nil || line != "ls -la" {
+		t.Error("last command should be ls -la, got", line, err)
+	}
+
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "ls -la" {
+		t.Error("daemon should return the added command, got", namesOfCmds(results))
+	}
+
+	// A client that doesn't send a request is disconnected
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Error("an idle client should be disconnected, got", err)
+	}
+	conn.Close()
+
+	l.Close()
+	<-done
+
+	// Without the daemon the database is used directly
+	results, err = s.ResultsGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Error("direct access should return the added command, got", namesOfCmds(results))
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s := new(Session)
+	s.Store = NewMemoryStore()
+	s.env = map[string]string{"R_DIRHISTORY": "2", "R_GLOBALHISTORY": "3"}
+
+	start := time.Now().Add(-time.Hour)
+	for i, cmd := range []string{"ls -a", "ls -b", "ls -c", "ls -a", "ls -d"} {
+		run := &Run{Dir: "/tmp", Start: start.Add(time.Duration(i) * time.Minute)}
+		if cmd == "ls -d" {
+			run.Dir = "/"
+		}
+
+		err := s.AddRun(cmd, run)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(results); len(names) != 2 || names[0] != "ls -a" || names[1] != "ls -c" {
+		t.Error("directory should keep the 2 most recently used commands, got", names)
+	}
+
+	results, err = s.ResultsGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(results); len(names) != 3 || names[0] != "ls -d" || names[2] != "ls -c" {
+		t.Error("global history should keep the 3 most recently used commands, got", names)
+	}
+
+	runs, err := s.Runs("ls -b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 0 {
+		t.Error("runs of a command pruned globally should be deleted, got", len(runs))
+	}
+}
+
+func TestResultsLimit(t *testing.T) {
+	s := new(Session)
+	s.Store = NewMemoryStore()
+
+	start := time.Now().Add(-time.Hour)
+	for i, cmd := range []string{"ls -a", "ls -b", "ls -b", "ls -c", "ls -a", "ls -a"} {
+		run := &Run{Dir: "/tmp", Start: start.Add(time.Duration(i) * time.Minute)}
+		if cmd == "ls -c" {
+			run.Exit = 1
+		}
+
+		err := s.AddRun(cmd, run)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Failed commands are skipped before the limit
+	s.Limit = 2
+	results, err := s.ResultsGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(results); len(names) != 2 || names[0] != "ls -a" || names[1] != "ls -b" {
+		t.Error("should return the 2 most recent commands, got", names)
+	}
+
+	s.SortUsage = true
+	s.Limit = 1
+	results, err = s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Name != "ls -a" || results[0].Info.Count != 3 || results[0].Dir != "/tmp" {
+		t.Error("should return the most used command, got", namesOfCmds(results))
+	}
+
+	s.SortUsage = false
+	s.Failed = true
+	s.Limit = 0
+	results, err = s.ResultsGlobal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(results); len(names) != 1 || names[0] != "ls -c" {
+		t.Error("should return the failed command, got", names)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	s := new(Session)
+	s.Store = NewMemoryStore()
+	s.env = map[string]string{"R_DIRHISTORY": "2", "R_GLOBALHISTORY": "2"}
+
+	start := time.Now().Add(-time.Hour)
+	for i, cmd := range []string{"ls -a", "ls -b", "ls -c"} {
+		err := s.AddRun(cmd, &Run{Dir: "/tmp", Start: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archived, err := s.ResultsArchive("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(archived); len(names) != 1 || names[0] != "ls -a" {
+		t.Error("pruned command should be archived for the directory, got", names)
+	}
+
+	s.Global = true
+	archived, err = s.ResultsArchive("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(archived); len(names) != 1 || names[0] != "ls -a" {
+		t.Error("pruned command should be archived globally, got", names)
+	}
+	s.Global = false
+
+	err = s.Restore("ls -a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(results); len(names) != 2 || names[0] != "ls -a" || names[1] != "ls -c" {
+		t.Error("restored command should be the most recent, got", names)
+	}
+
+	archived, err = s.ResultsArchive("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := namesOfCmds(archived); len(names) != 1 || names[0] != "ls -b" {
+		t.Error("least recently used command should be archived in its place, got", names)
+	}
+
+	if s.Restore("ls -z") == nil {
+		t.Error("restoring a command that isn't archived should fail")
+	}
+}
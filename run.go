@@ -0,0 +1,226 @@
+package r
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+const runBucket = "RunBucket" // BoltDB bucket storing the latest runs of each command
+
+// maxRuns is how many runs of a command are kept. Older runs are deleted
+// as new ones are stored
+const maxRuns = 200
+
+// Run is a single execution of a command. The latest runs are kept in
+// the runBucket and added to the CommandInfo aggregates as they're stored
+type Run struct {
+	Start    time.Time     // When the command started
+	Duration time.Duration // How long the command took
+	Exit     int           // Exit status of the command
+	Session  string        // tty or shell session the command ran in
+	Hostname string        // Host the command ran on
+	Dir      string        // Working directory of the command
+	Repo     string        // Identity of the git repository of Dir
+}
+
+// runKey returns the big-endian key for a run so runs are
+// stored in the order they started
+func runKey(start time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(start.UnixNano()))
+	return key
+}
+
+// putRun stores the run in the command's run bucket and deletes the
+// oldest runs past maxRuns
+func putRun(tx Tx, cmd string, run *Run) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(runBucket))
+	if err != nil {
+		return err
+	}
+
+	cmdBucket, err := b.CreateBucketIfNotExists([]byte(cmd))
+	if err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	// Two runs can't share a key so move a colliding run forward
+	key := runKey(run.Start)
+	for cmdBucket.Get(key) != nil {
+		binary.BigEndian.PutUint64(key, binary.BigEndian.Uint64(key)+1)
+	}
+
+	err = cmdBucket.Put(key, v)
+	if err != nil {
+		return err
+	}
+
+	return trimRuns(cmdBucket, maxRuns)
+}
+
+// trimRuns deletes the oldest runs of the run bucket b past limit
+func trimRuns(b Bucket, limit int) error {
+	var old [][]byte
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		n++
+		if n > limit {
+			old = append(old, append([]byte{}, k...))
+		}
+	}
+
+	for _, k := range old {
+		err := b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putRunOnce stores the run unless the same run is already stored
+func putRunOnce(tx Tx, cmd string, run *Run) error {
+	v, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	if b := tx.Bucket([]byte(runBucket)); b != nil {
+		if cmdBucket := b.Bucket([]byte(cmd)); cmdBucket != nil {
+			// Look through the runs moved forward by putRun too
+			key := runKey(run.Start)
+			for stored := cmdBucket.Get(key); stored != nil; stored = cmdBucket.Get(key) {
+				if bytes.Equal(stored, v) {
+					return nil
+				}
+				binary.BigEndian.PutUint64(key, binary.BigEndian.Uint64(key)+1)
+			}
+		}
+	}
+
+	return putRun(tx, cmd, run)
+}
+
+// readRuns returns the stored runs of cmd, oldest first
+func readRuns(tx Tx, cmd string) ([]*Run, error) {
+	b := tx.Bucket([]byte(runBucket))
+	if b == nil {
+		return nil, nil
+	}
+
+	cmdBucket := b.Bucket([]byte(cmd))
+	if cmdBucket == nil {
+		return nil, nil
+	}
+
+	var runs []*Run
+	err := cmdBucket.ForEach(func(k, v []byte) error {
+		run := new(Run)
+		err := json.Unmarshal(v, run)
+		if err != nil {
+			return err
+		}
+
+		runs = append(runs, run)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// deleteRuns removes every run of cmd
+func deleteRuns(tx Tx, cmd string) error {
+	b := tx.Bucket([]byte(runBucket))
+	if b == nil || b.Bucket([]byte(cmd)) == nil {
+		return nil
+	}
+
+	return b.DeleteBucket([]byte(cmd))
+}
+
+// inDir keeps the runs in dir
+func inDir(dir string) func(*Run) bool {
+	return func(run *Run) bool {
+		return run.Dir == dir
+	}
+}
+
+// inRepo keeps the runs in the git repository with the id
+func inRepo(id string) func(*Run) bool {
+	return func(run *Run) bool {
+		return run.Repo == id
+	}
+}
+
+// addInfo adds run to the CommandInfo aggregate prev. prev is nil for
+// a command that isn't stored yet
+func addInfo(prev *CommandInfo, run *Run) *CommandInfo {
+	ci := prev
+	if ci == nil {
+		ci = new(CommandInfo)
+	}
+
+	ci.Count++
+	if !run.Start.Before(ci.Time) {
+		ci.Time = run.Start
+		ci.Exit = run.Exit
+	}
+
+	return ci
+}
+
+// Runs returns the latest recorded runs of cmd, oldest first
+func (s *Session) Runs(cmd string) ([]*Run, error) {
+	if resp, ok, err := s.remote(&request{Op: "runs", Command: cmd}); ok {
+		if err != nil {
+			return nil, err
+		}
+		return resp.Runs, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []*Run
+	err = db.View(func(tx Tx) error {
+		runs, err = readRuns(tx, cmd)
+		return err
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// LastRun returns the most recent run of cmd. It returns nil
+// when cmd has never been recorded
+func (s *Session) LastRun(cmd string) (*Run, error) {
+	runs, err := s.Runs(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(runs) == 0 {
+		return nil, nil
+	}
+
+	return runs[len(runs)-1], nil
+}
@@ -0,0 +1,367 @@
+package r
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	metaBucket = "MetaBucket" // BoltDB bucket storing database metadata
+	versionKey = "version"    // Key in the metaBucket storing the schema version
+
+	// hookArtifact is a command older versions of the bash hook stored by mistake
+	hookArtifact = `[ "$LAST_CMD" = "r" ]`
+)
+
+// errDryRun is returned from a migration transaction to roll it back
+var errDryRun = errors.New("dry run")
+
+// migration upgrades the database from version-1 to version. Every change
+// it makes is described by calling report
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx Tx, report func(format string, a ...interface{})) error
+}
+
+// migrations in the order they are applied. The last migration's
+// version is the current schema version
+var migrations = []migration{
+	{1, "remove hook artifacts and repair malformed command info", migrateRepairInfo},
+	{2, "add exit status to command info", migrateInfoExit},
+	{3, "index command info by last used time", migrateTimeIndex},
+	{4, "index command info by use count", migrateCountIndex},
+}
+
+// SchemaVersion is the database schema version this package reads and writes
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// open returns the Store of the Session upgraded to the current schema.
+// Without a Store the Bolt database at BoltPath is opened and, when
+// it is encrypted, unlocked
+func (s *Session) open() (Store, error) {
+	store := s.Store
+	if store == nil {
+		var err error
+		store, err = s.openStore()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err := migrate(store, false)
+	if err != nil {
+		s.close(store)
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// close closes store unless it's the Store of the Session
+func (s *Session) close(store Store) {
+	if store != s.Store {
+		store.Close()
+	}
+}
+
+// Migrate upgrades the database to the current schema version and returns a
+// description of every change. When dryRun is true nothing is written
+func (s *Session) Migrate(dryRun bool) ([]string, error) {
+	if resp, ok, err := s.remote(&request{Op: "migrate", DryRun: dryRun}); ok {
+		if err != nil {
+			return nil, err
+		}
+		return resp.Changes, nil
+	}
+
+	store := s.Store
+	if store == nil {
+		var err error
+		store, err = s.openStore()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := migrate(store, dryRun)
+
+	s.close(store)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// readVersion returns the schema version stored in the database. Databases
+// created before the metaBucket existed are version 0
+func readVersion(tx Tx) (int, error) {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return 0, nil
+	}
+
+	v := b.Get([]byte(versionKey))
+	if v == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(v))
+}
+
+func writeVersion(tx Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(versionKey), []byte(strconv.Itoa(version)))
+}
+
+// isEmpty checks if the database doesn't have any buckets yet
+func isEmpty(tx Tx) bool {
+	empty := true
+	tx.ForEach(func(name []byte, b Bucket) error {
+		empty = false
+		return errors.New("not empty")
+	})
+	return empty
+}
+
+// migrate runs every migration newer than the database's schema
+// version in a single transaction. The version is read again in that
+// transaction so two processes opening an old database don't both
+// migrate it
+func migrate(db Store, dryRun bool) ([]string, error) {
+	// Up to date databases only need a read transaction
+	var version int
+	err := db.View(func(tx Tx) error {
+		var err error
+		version, err = readVersion(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	current := SchemaVersion()
+	if version == current {
+		return nil, nil
+	}
+
+	var changes []string
+	report := func(format string, a ...interface{}) {
+		changes = append(changes, fmt.Sprintf(format, a...))
+	}
+
+	err = db.Update(func(tx Tx) error {
+		version, err := readVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > current {
+			return fmt.Errorf("database schema version %d is newer than r supports (%d). Upgrade r", version, current)
+		}
+		if version == current {
+			return nil
+		}
+
+		// A new database starts at the current version
+		if !isEmpty(tx) {
+			for _, m := range migrations {
+				if m.version <= version {
+					continue
+				}
+
+				report("migration %d: %s", m.version, m.description)
+				err := m.migrate(tx, report)
+				if err != nil {
+					return fmt.Errorf("migration %d: %s", m.version, err)
+				}
+			}
+		}
+
+		report("set schema version %d -> %d", version, current)
+		err = writeVersion(tx, current)
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// migrateRepairInfo removes hook artifacts and rewrites command info values
+// that can't be parsed from the global bucket and every directory bucket
+func migrateRepairInfo(tx Tx, report func(format string, a ...interface{})) error {
+	repair := func(names []string, b Bucket) error {
+		name := strings.Join(names, "/")
+		var remove, rewrite []string
+		values := make(map[string]string)
+		err := b.ForEach(func(k, v []byte) error {
+			// Skip nested buckets
+			if v == nil {
+				return nil
+			}
+
+			if string(k) == hookArtifact {
+				remove = append(remove, string(k))
+				return nil
+			}
+
+			if !validInfo(string(v)) {
+				rewrite = append(rewrite, string(k))
+				values[string(k)] = new(CommandInfo).NewFromString(string(v)).String()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Bolt doesn't allow changing a bucket while iterating it
+		for _, k := range remove {
+			report("%s: remove %q", name, k)
+			err = b.Delete([]byte(k))
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, k := range rewrite {
+			report("%s: repair value of %q", name, k)
+			err = b.Put([]byte(k), []byte(values[k]))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return forEachInfoBucket(tx, repair)
+}
+
+// validInfo checks if a command info value is in "RFC3339,count" or
+// "RFC3339,count,exit" format
+func validInfo(v string) bool {
+	info := strings.Split(v, ",")
+	if len(info) != 2 && len(info) != 3 {
+		return false
+	}
+
+	if _, err := time.Parse(time.RFC3339, info[0]); err != nil {
+		return false
+	}
+
+	for _, n := range info[1:] {
+		if _, err := strconv.Atoi(n); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// migrateInfoExit rewrites "RFC3339,count" command info values as
+// "RFC3339,count,exit". Only successful commands were stored before
+// so every exit status is 0
+func migrateInfoExit(tx Tx, report func(format string, a ...interface{})) error {
+	count := 0
+	err := forEachInfoBucket(tx, func(names []string, b Bucket) error {
+		var keys []string
+		err := b.ForEach(func(k, v []byte) error {
+			if v != nil && strings.Count(string(v), ",") == 1 {
+				keys = append(keys, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			v := b.Get([]byte(k))
+			err = b.Put([]byte(k), []byte(string(v)+",0"))
+			if err != nil {
+				return err
+			}
+		}
+
+		count += len(keys)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	report("add exit status 0 to %d command info values", count)
+	return nil
+}
+
+// forEachInfoBucket calls fn with the path of nested bucket names of the
+// global bucket and every directory and repository bucket, which all
+// store command info values
+func forEachInfoBucket(tx Tx, fn func(names []string, b Bucket) error) error {
+	return forEachInfoBucketIn(tx, nil, fn)
+}
+
+// forEachInfoBucketIn calls fn with every command info bucket nested in
+// the buckets at root. The names fn gets don't include root
+func forEachInfoBucketIn(tx Tx, root []string, fn func(names []string, b Bucket) error) error {
+	find := func(names ...string) Bucket {
+		return findBuckets(tx, append(append([]string{}, root...), names...))
+	}
+
+	if b := find(globalCommandBucket); b != nil {
+		err := fn([]string{globalCommandBucket}, b)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, parent := range []string{directoryBucket, repoBucket} {
+		b := find(parent)
+		if b == nil {
+			continue
+		}
+
+		var keys []string
+		err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			nested := b.Bucket([]byte(key))
+			if nested == nil {
+				continue
+			}
+
+			err = fn([]string{parent, key}, nested)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
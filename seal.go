@@ -0,0 +1,429 @@
+package r
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	sealedBucket = "SealedBucket" // BoltDB bucket marking a sealed database. Every other bucket name, key and value is sealed
+	paramsKey    = "params"       // Key in the sealedBucket storing how to get the key of the database
+	checkKey     = "check"        // Key in the sealedBucket storing checkValue sealed to check the key with
+	checkValue   = "r"
+)
+
+// Errors opening a sealed database
+var (
+	ErrSealed    = errors.New("the r database is encrypted and can't be opened without its key")
+	errNotSealed = errors.New("the r database isn't encrypted")
+	errWrongKey  = errors.New("wrong key for the encrypted r database")
+)
+
+// Cipher seals the bucket names, keys and values of a SealedStore
+type Cipher interface {
+	// SealKey seals a bucket name or key. It has to seal the same key
+	// the same way every time so the key can be looked up
+	SealKey(key []byte) []byte
+	// Seal seals a value
+	Seal(value []byte) []byte
+	// Open returns what SealKey or Seal sealed
+	Open(sealed []byte) ([]byte, error)
+}
+
+// SealedStore is a Store whose contents are sealed by a Cipher in
+// another Store. The contents are kept opened in memory so reads and
+// cursors work as usual. Writes go to both
+type SealedStore struct {
+	store  Store
+	mem    *MemoryStore
+	cipher Cipher
+	err    error // Set when the opened contents no longer match the sealed store
+}
+
+// NewSealedStore opens the sealed store with c
+func NewSealedStore(store Store, c Cipher) (*SealedStore, error) {
+	s := &SealedStore{store: store, cipher: c}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load opens the sealed contents into memory. The whole database is
+// opened every time a SealedStore is made, so every hook pays for it
+// unless r daemon holds the database open
+func (s *SealedStore) load() error {
+	mem := NewMemoryStore()
+	err := s.store.View(func(stx Tx) error {
+		b := stx.Bucket([]byte(sealedBucket))
+		if b == nil {
+			return errNotSealed
+		}
+
+		check, err := s.cipher.Open(b.Get([]byte(checkKey)))
+		if err != nil || string(check) != checkValue {
+			return errWrongKey
+		}
+
+		return mem.Update(func(mtx Tx) error {
+			return stx.ForEach(func(name []byte, b Bucket) error {
+				if string(name) == sealedBucket {
+					return nil
+				}
+
+				name, err := s.cipher.Open(name)
+				if err != nil {
+					return err
+				}
+
+				nested, err := mtx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+
+				return openBucket(nested, b, s.cipher)
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mem = mem
+	return nil
+}
+
+// openBucket opens every key and nested bucket of src into dst
+func openBucket(dst, src Bucket, c Cipher) error {
+	return src.ForEach(func(sealedKey, v []byte) error {
+		k, err := c.Open(sealedKey)
+		if err != nil {
+			return err
+		}
+
+		if v == nil {
+			nested, err := dst.CreateBucketIfNotExists(k)
+			if err != nil {
+				return err
+			}
+
+			return openBucket(nested, src.Bucket(sealedKey), c)
+		}
+
+		v, err = c.Open(v)
+		if err != nil {
+			return err
+		}
+
+		return dst.Put(k, v)
+	})
+}
+
+// View runs fn on the opened contents
+func (s *SealedStore) View(fn func(tx Tx) error) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	return s.mem.View(fn)
+}
+
+// Update runs fn on the opened contents and seals what it writes in the
+// same transaction of the sealed store
+func (s *SealedStore) Update(fn func(tx Tx) error) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	opened := false
+	err := s.store.Update(func(stx Tx) error {
+		err := s.mem.Update(func(mtx Tx) error {
+			return fn(&sealedTx{mtx, stx, s.cipher})
+		})
+		opened = err == nil
+		return err
+	})
+
+	// The sealed store failed to commit what's already in memory. Without
+	// reloading it the memory has writes that aren't stored so the store
+	// can't be used anymore
+	if err != nil && opened {
+		loadErr := s.load()
+		if loadErr != nil {
+			s.err = fmt.Errorf("the encrypted r database couldn't be reloaded after %s: %s", err, loadErr)
+			return s.err
+		}
+	}
+
+	return err
+}
+
+// Close closes the sealed store
+func (s *SealedStore) Close() error {
+	return s.store.Close()
+}
+
+// sealedTx is a transaction on the opened contents of a SealedStore
+// and the matching transaction of the sealed store
+type sealedTx struct {
+	mem    Tx
+	sealed Tx
+	cipher Cipher
+}
+
+func (t *sealedTx) Bucket(name []byte) Bucket {
+	b := t.mem.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return sealedBucketTx{b, t.sealed.Bucket(t.cipher.SealKey(name)), t.cipher}
+}
+
+func (t *sealedTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.mem.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := t.sealed.CreateBucketIfNotExists(t.cipher.SealKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return sealedBucketTx{b, sealed, t.cipher}, nil
+}
+
+func (t *sealedTx) DeleteBucket(name []byte) error {
+	err := t.mem.DeleteBucket(name)
+	if err != nil {
+		return err
+	}
+
+	return t.sealed.DeleteBucket(t.cipher.SealKey(name))
+}
+
+func (t *sealedTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	return t.mem.ForEach(func(name []byte, b Bucket) error {
+		return fn(name, sealedBucketTx{b, t.sealed.Bucket(t.cipher.SealKey(name)), t.cipher})
+	})
+}
+
+func (t *sealedTx) Writable() bool {
+	return true
+}
+
+// sealedBucketTx is an opened bucket and its sealed counterpart
+type sealedBucketTx struct {
+	mem    Bucket
+	sealed Bucket
+	cipher Cipher
+}
+
+func (b sealedBucketTx) Get(key []byte) []byte {
+	return b.mem.Get(key)
+}
+
+func (b sealedBucketTx) Put(key []byte, value []byte) error {
+	err := b.mem.Put(key, value)
+	if err != nil {
+		return err
+	}
+
+	return b.sealed.Put(b.cipher.SealKey(key), b.cipher.Seal(value))
+}
+
+func (b sealedBucketTx) Delete(key []byte) error {
+	err := b.mem.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	return b.sealed.Delete(b.cipher.SealKey(key))
+}
+
+func (b sealedBucketTx) Bucket(name []byte) Bucket {
+	nested := b.mem.Bucket(name)
+	if nested == nil {
+		return nil
+	}
+	return sealedBucketTx{nested, b.sealed.Bucket(b.cipher.SealKey(name)), b.cipher}
+}
+
+func (b sealedBucketTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nested, err := b.mem.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := b.sealed.CreateBucketIfNotExists(b.cipher.SealKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return sealedBucketTx{nested, sealed, b.cipher}, nil
+}
+
+func (b sealedBucketTx) DeleteBucket(name []byte) error {
+	err := b.mem.DeleteBucket(name)
+	if err != nil {
+		return err
+	}
+
+	return b.sealed.DeleteBucket(b.cipher.SealKey(name))
+}
+
+func (b sealedBucketTx) ForEach(fn func(k, v []byte) error) error {
+	return b.mem.ForEach(fn)
+}
+
+func (b sealedBucketTx) Cursor() Cursor {
+	return b.mem.Cursor()
+}
+
+// sealedParams returns the params stored with a sealed store and
+// false when the store isn't sealed
+func sealedParams(store Store) ([]byte, bool, error) {
+	var params []byte
+	sealed := false
+	err := store.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(sealedBucket))
+		if b == nil {
+			return nil
+		}
+
+		sealed = true
+		params = append([]byte{}, b.Get([]byte(paramsKey))...)
+		return nil
+	})
+
+	return params, sealed, err
+}
+
+// unseal returns the SealedStore of store, unlocked with the Cipher
+// Unlock returns, or store itself when it isn't sealed
+func (s *Session) unseal(store Store) (Store, error) {
+	params, sealed, err := sealedParams(store)
+	if err != nil || !sealed {
+		return store, err
+	}
+
+	if s.Unlock == nil {
+		return nil, ErrSealed
+	}
+
+	c, err := s.Unlock(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSealedStore(store, c)
+}
+
+// openStore opens the Bolt database at BoltPath, unsealed
+func (s *Session) openStore() (Store, error) {
+	bolt, err := OpenBoltStore(s.BoltPath)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := s.unseal(bolt)
+	if err != nil {
+		bolt.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Encrypt seals the Bolt database at BoltPath with c. params are stored
+// in the clear and given to Unlock to get c back when the database is
+// opened. The sealed copy is written next to the database then replaces
+// it so no plaintext is left behind in its free pages
+func (s *Session) Encrypt(c Cipher, params []byte) error {
+	return s.rewrite(func(dst, src Store) error {
+		_, sealed, err := sealedParams(src)
+		if err != nil {
+			return err
+		}
+		if sealed {
+			return errors.New("the r database is already encrypted")
+		}
+
+		err = dst.Update(func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte(sealedBucket))
+			if err != nil {
+				return err
+			}
+
+			err = b.Put([]byte(paramsKey), params)
+			if err != nil {
+				return err
+			}
+
+			return b.Put([]byte(checkKey), c.Seal([]byte(checkValue)))
+		})
+		if err != nil {
+			return err
+		}
+
+		sealedDst, err := NewSealedStore(dst, c)
+		if err != nil {
+			return err
+		}
+
+		return copyStore(sealedDst, src)
+	})
+}
+
+// Decrypt replaces the sealed Bolt database at BoltPath with
+// an unsealed copy. Unlock gets the Cipher it was sealed with
+func (s *Session) Decrypt() error {
+	return s.rewrite(func(dst, src Store) error {
+		_, sealed, err := sealedParams(src)
+		if err != nil {
+			return err
+		}
+		if !sealed {
+			return errNotSealed
+		}
+
+		opened, err := s.unseal(src)
+		if err != nil {
+			return err
+		}
+
+		return copyStore(dst, opened)
+	})
+}
+
+// rewrite replaces the Bolt database at BoltPath with the new
+// database write makes from it. The old database stays locked until it's
+// replaced and Sessions waiting for it open the new one
+func (s *Session) rewrite(write func(dst, src Store) error) error {
+	src, err := OpenBoltStore(s.BoltPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := s.BoltPath + ".tmp"
+	os.Remove(tmp)
+	dst, err := OpenBoltStore(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = write(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, s.BoltPath)
+}
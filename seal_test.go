@@ -0,0 +1,190 @@
+package r
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// xorCipher seals by xoring every byte with a key byte. The key byte is
+// prepended so opening with another key fails
+type xorCipher byte
+
+func (c xorCipher) SealKey(key []byte) []byte {
+	sealed := []byte{byte(c)}
+	for _, b := range key {
+		sealed = append(sealed, b^byte(c))
+	}
+	return sealed
+}
+
+func (c xorCipher) Seal(value []byte) []byte {
+	return c.SealKey(value)
+}
+
+func (c xorCipher) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) == 0 || sealed[0] != byte(c) {
+		return nil, errors.New("wrong key")
+	}
+	return c.SealKey(sealed[1:])[1:], nil
+}
+
+func TestEncrypt(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s := new(Session)
+	s.BoltPath = f.Name()
+	err = s.AddRun("ls -secret", &Run{Dir: "/tmp/secret", Start: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var params []byte
+	s.Unlock = func(p []byte) (Cipher, error) {
+		params = p
+		return xorCipher(7), nil
+	}
+
+	err = s.Encrypt(xorCipher(7), []byte("params"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("the encrypted database shouldn't contain plaintext")
+	}
+
+	err = s.AddRun("ls -secret", &Run{Dir: "/tmp/secret", Start: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(params) != "params" {
+		t.Errorf("Unlock should get the params, got %q", params)
+	}
+
+	results := mustResults(t)(s.ResultsDirectory("/tmp/secret"))
+	if len(results) != 1 || results[0].Info.Count != 2 {
+		t.Fatal("the encrypted history should keep counting, got", namesOfCmds(results))
+	}
+
+	unlock := s.Unlock
+	s.Unlock = nil
+	if _, err := s.ResultsGlobal(); err != ErrSealed {
+		t.Error("opening without Unlock should fail with ErrSealed, got", err)
+	}
+
+	s.Unlock = func([]byte) (Cipher, error) {
+		return xorCipher(8), nil
+	}
+	if _, err := s.ResultsGlobal(); err != errWrongKey {
+		t.Error("opening with the wrong key should fail, got", err)
+	}
+
+	s.Unlock = unlock
+	err = s.Decrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Unlock = nil
+	results = mustResults(t)(s.ResultsDirectory("/tmp/secret"))
+	if len(results) != 1 || results[0].Info.Count != 2 {
+		t.Fatal("decrypting should keep the history, got", namesOfCmds(results))
+	}
+
+	if s.Decrypt() != errNotSealed {
+		t.Error("decrypting a plain database should fail")
+	}
+}
+
+// failingStore fails committing every Update and, when failView is set,
+// every View
+type failingStore struct {
+	Store
+	failView bool
+}
+
+var errCommit = errors.New("commit failed")
+
+func (s *failingStore) View(fn func(tx Tx) error) error {
+	if s.failView {
+		return errors.New("view failed")
+	}
+	return s.Store.View(fn)
+}
+
+func (s *failingStore) Update(fn func(tx Tx) error) error {
+	return s.Store.Update(func(tx Tx) error {
+		err := fn(tx)
+		if err != nil {
+			return err
+		}
+		return errCommit
+	})
+}
+
+func TestSealedUpdateRollback(t *testing.T) {
+	mem := NewMemoryStore()
+	err := mem.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(sealedBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(checkKey), xorCipher(7).Seal([]byte(checkValue)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := &failingStore{Store: mem}
+	sealed, err := NewSealedStore(failing, xorCipher(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func() error {
+		return sealed.Update(func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("bucket"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("key"), []byte("value"))
+		})
+	}
+
+	// A failed commit leaves nothing in memory
+	if err := put(); err != errCommit {
+		t.Fatal("the commit error should be returned, got", err)
+	}
+	err = sealed.View(func(tx Tx) error {
+		if tx.Bucket([]byte("bucket")) != nil {
+			return errors.New("a failed update should be rolled back in memory")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// When reloading fails too the store can't be used
+	failing.failView = true
+	if err := put(); err == nil || err == errCommit {
+		t.Fatal("the reload error should be returned, got", err)
+	}
+	failing.failView = false
+	if err := sealed.View(func(tx Tx) error { return nil }); err == nil {
+		t.Error("a store that couldn't be reloaded shouldn't be read")
+	}
+}
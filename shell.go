@@ -0,0 +1,107 @@
+package r
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// shellBuiltins are the builtins and keywords of bash, zsh and fish that
+// aren't in $PATH. The hooks pass aliases and functions on top of them
+var shellBuiltins = []string{
+	".", ":", "[[", "alias", "bg", "bind", "break", "builtin", "case", "cd",
+	"command", "continue", "declare", "dirs", "disown", "do", "done", "echo",
+	"elif", "else", "end", "esac", "eval", "exec", "exit", "export", "fc",
+	"fg", "fi", "for", "function", "functions", "getopts", "hash", "help",
+	"history", "if", "jobs", "kill", "let", "local", "popd", "printf",
+	"pushd", "pwd", "read", "readonly", "rehash", "return", "select", "set",
+	"setopt", "shift", "shopt", "source", "suspend", "then", "time", "trap",
+	"type", "typeset", "ulimit", "umask", "unalias", "unfunction", "unset",
+	"unsetopt", "until", "wait", "which", "while", "abbr", "funced",
+	"funcsave",
+}
+
+// shellWrappers run the command that follows them. The value holds the
+// options of the wrapper taking an argument, ex. sudo -u root
+var shellWrappers = map[string]string{
+	"sudo":    "CDghpRrTtUu",
+	"doas":    "Cu",
+	"time":    "fo",
+	"nohup":   "",
+	"nice":    "n",
+	"env":     "CSu",
+	"exec":    "a",
+	"builtin": "",
+}
+
+// assignment matches a variable assignment prefixing a command, ex. VAR=1
+var assignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\[[^]]*\])?\+?=`)
+
+// shellCommands returns the builtins and keywords of the shells followed
+// by the Session's ShellCommands or the names in R_SHELL_COMMANDS,
+// separated by white space
+func (s *Session) shellCommands() []string {
+	names := s.ShellCommands
+	if len(names) == 0 {
+		names = strings.Fields(s.getenv("R_SHELL_COMMANDS"))
+	}
+
+	return append(append([]string{}, shellBuiltins...), names...)
+}
+
+// firstCommand returns the program the first command of promptCmd runs.
+// It's empty when promptCmd can't be parsed
+func firstCommand(promptCmd string) string {
+	line, err := ParseCommandLine(promptCmd)
+	if err != nil || len(line.Commands) == 0 {
+		return ""
+	}
+
+	program := line.Commands[0].Program()
+	if program == nil {
+		return ""
+	}
+	return program.Text
+}
+
+// knownCommand checks if cmd ran in dir can be found. Paths are checked
+// for an executable, relative ones only when dir is known. Other commands
+// are looked up in executables and in the shell's builtins, aliases and
+// functions
+func (s *Session) knownCommand(dir string, cmd string, executables map[string]bool) bool {
+	if cmd == "" {
+		return false
+	}
+
+	if strings.Contains(cmd, "/") {
+		if strings.HasPrefix(cmd, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return false
+			}
+			cmd = filepath.Join(home, cmd[2:])
+		}
+
+		if !filepath.IsAbs(cmd) {
+			if dir == "" || dir == UnknownDir {
+				return true
+			}
+			cmd = filepath.Join(dir, cmd)
+		}
+
+		info, err := os.Stat(cmd)
+		return err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0
+	}
+
+	if executables[cmd] {
+		return true
+	}
+
+	for _, name := range s.shellCommands() {
+		if name == cmd {
+			return true
+		}
+	}
+	return false
+}
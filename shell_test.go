@@ -0,0 +1,80 @@
+package r
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFirstCommand(t *testing.T) {
+	for _, test := range []struct {
+		promptCmd, cmd string
+	}{
+		{"ls -la", "ls"},
+		{"  ls", "ls"},
+		{"VAR=1 make test", "make"},
+		{"A=1 B='a b' go test", "go"},
+		{"PATH+=:/bin arr[0]=x ls", "ls"},
+		{"./build.sh -v", "./build.sh"},
+		{"'./my script.sh'", "./my script.sh"},
+		{`my\ script.sh`, "my script.sh"},
+		{"sudo -u root -E apt update", "apt"},
+		{"sudo -- ls", "ls"},
+		{"time -p go build", "go"},
+		{"nohup sudo VAR=1 nice -n 10 ./run &", "./run"},
+		{"env -u HOME FOO=bar printenv", "printenv"},
+		{"(cd dir && make)", "cd"},
+		{"{ make; make test; }", "make"},
+		{"! grep -q x file", "grep"},
+		{"git status | less", "git"},
+		{"sudo", "sudo"},
+		{"VAR=1", ""},
+		{"", ""},
+	} {
+		if cmd := firstCommand(test.promptCmd); cmd != test.cmd {
+			t.Errorf("%q: expected %q, got %q", test.promptCmd, test.cmd, cmd)
+		}
+	}
+}
+
+func TestKnownCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(Session)
+	s.env = map[string]string{"R_SHELL_COMMANDS": "gs\nmkcd ll"}
+
+	for _, test := range []struct {
+		dir, cmd string
+		known    bool
+	}{
+		{dir, "ls", true},
+		{dir, "cd", true},
+		{dir, "gs", true},
+		{dir, "ll", true},
+		{dir, "lss", false},
+		{dir, "./build.sh", true},
+		{dir, "./notes.txt", false},
+		{dir, "./missing.sh", false},
+		{"/", filepath.Join(dir, "build.sh"), true},
+		{UnknownDir, "./build.sh", true},
+		{dir, "", false},
+	} {
+		if known := s.knownCommand(test.dir, test.cmd, map[string]bool{"ls": true}); known != test.known {
+			t.Errorf("%q in %s known should be %v", test.cmd, test.dir, test.known)
+		}
+	}
+}
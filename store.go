@@ -0,0 +1,221 @@
+package r
+
+import (
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store is the transactional key/value store a Session keeps its history
+// in. Keys are kept in byte order and buckets can be nested
+type Store interface {
+	// View runs fn in a read-only transaction
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a read-write transaction. The transaction is
+	// rolled back when fn returns an error
+	Update(fn func(tx Tx) error) error
+	// Close releases the Store
+	Close() error
+}
+
+// Tx is a transaction of a Store
+type Tx interface {
+	// Bucket returns the top level bucket name or nil when it doesn't exist
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	// ForEach calls fn with every top level bucket
+	ForEach(fn func(name []byte, b Bucket) error) error
+	Writable() bool
+}
+
+// Bucket is a collection of keys and nested buckets inside a transaction
+type Bucket interface {
+	// Get returns the value of key or nil when key isn't set or is a bucket
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Bucket returns the nested bucket name or nil when it doesn't exist
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	// ForEach calls fn with every key in order. The value
+	// of a nested bucket is nil
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() Cursor
+}
+
+// Cursor iterates the keys of a bucket in order. Every method returns
+// a nil key past either end and a nil value for nested buckets
+type Cursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	// Seek moves to key or the key after it when key doesn't exist
+	Seek(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+}
+
+// copyStore copies every bucket and key of src into dst
+func copyStore(dst, src Store) error {
+	return src.View(func(stx Tx) error {
+		return dst.Update(func(dtx Tx) error {
+			return stx.ForEach(func(name []byte, b Bucket) error {
+				nested, err := dtx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+
+				return copyBucket(nested, b)
+			})
+		})
+	})
+}
+
+// copyBucket copies every key and nested bucket of src into dst
+func copyBucket(dst, src Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		nested, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
+
+// BoltStore is a Store in a Bolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the Bolt database at path. Bolt locks
+// the file so only one BoltStore can have it open at a time
+func OpenBoltStore(path string) (*BoltStore, error) {
+	return openBoltStore(path, false)
+}
+
+// openBoltStore opens the Bolt database at path. A read-only
+// BoltStore shares the file lock with other readers
+func openBoltStore(path string, readOnly bool) (*BoltStore, error) {
+	for {
+		before, statErr := os.Stat(path)
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+		if err != nil {
+			return nil, err
+		}
+
+		// r db encrypt and decrypt replace the file while holding its
+		// lock. Waiting for that lock leaves the replaced file open, so
+		// open the new one rather than write where nobody reads
+		after, err := os.Stat(path)
+		if statErr != nil || err != nil || os.SameFile(before, after) {
+			return &BoltStore{db: db}, nil
+		}
+		db.Close()
+	}
+}
+
+// View runs fn in a read-only Bolt transaction
+func (s *BoltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+// Update runs fn in a read-write Bolt transaction
+func (s *BoltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+// Close closes the Bolt database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltTx adapts a bolt.Tx to Tx
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	return wrapBucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+func (t boltTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	return t.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name, boltBucket{b})
+	})
+}
+
+func (t boltTx) Writable() bool {
+	return t.tx.Writable()
+}
+
+// boltBucket adapts a bolt.Bucket to Bucket
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// wrapBucket keeps a missing bolt.Bucket a nil Bucket
+func wrapBucket(b *bolt.Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key []byte, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) Bucket(name []byte) Bucket {
+	return wrapBucket(b.b.Bucket(name))
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nested, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{nested}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.b.Cursor()
+}
@@ -0,0 +1,201 @@
+package r
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testStores returns a BoltStore and a MemoryStore to run the same test on
+func testStores(t *testing.T) map[string]Store {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	bolt, err := OpenBoltStore(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]Store{"bolt": bolt, "memory": NewMemoryStore()}
+}
+
+func TestStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		if b, ok := store.(*BoltStore); ok {
+			defer os.Remove(b.db.Path())
+		}
+		defer store.Close()
+
+		err := store.Update(func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("outer"))
+			if err != nil {
+				return err
+			}
+
+			for _, k := range []string{"c", "a", "b"} {
+				err = b.Put([]byte(k), []byte("v"+k))
+				if err != nil {
+					return err
+				}
+			}
+
+			_, err = b.CreateBucketIfNotExists([]byte("bb"))
+			return err
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		// A failed transaction leaves the store as it was
+		failed := errors.New("rollback")
+		err = store.Update(func(tx Tx) error {
+			err := tx.Bucket([]byte("outer")).Put([]byte("d"), []byte("vd"))
+			if err != nil {
+				return err
+			}
+			return failed
+		})
+		if err != failed {
+			t.Error(name, "update should return the error of fn, got", err)
+		}
+
+		err = store.View(func(tx Tx) error {
+			if tx.Bucket([]byte("missing")) != nil {
+				t.Error(name, "missing bucket should be nil")
+			}
+
+			b := tx.Bucket([]byte("outer"))
+			if b.Get([]byte("d")) != nil {
+				t.Error(name, "rolled back key should not be stored")
+			}
+			if b.Put([]byte("e"), []byte("ve")) == nil {
+				t.Error(name, "read-only transaction should not write")
+			}
+
+			var keys string
+			b.ForEach(func(k, v []byte) error {
+				if string(k) == "bb" && v != nil {
+					t.Error(name, "nested bucket value should be nil")
+				}
+				keys += string(k) + " "
+				return nil
+			})
+			if keys != "a b bb c " {
+				t.Errorf("%s: keys should be in order, got %q", name, keys)
+			}
+
+			c := b.Cursor()
+			if k, v := c.Seek([]byte("ba")); string(k) != "bb" || v != nil {
+				t.Errorf("%s: seek should find the next key, got %q", name, k)
+			}
+			if k, _ := c.Next(); string(k) != "c" {
+				t.Errorf("%s: next key should be c, got %q", name, k)
+			}
+			if k, _ := c.Next(); k != nil {
+				t.Errorf("%s: cursor should end after c, got %q", name, k)
+			}
+			if k, _ := c.Last(); string(k) != "c" {
+				t.Errorf("%s: last key should be c, got %q", name, k)
+			}
+			if k, _ := c.Prev(); string(k) != "bb" {
+				t.Errorf("%s: previous key should be bb, got %q", name, k)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(name, err)
+		}
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	s := new(Session)
+	s.Store = NewMemoryStore()
+
+	err := s.Add(&Execution{Command: "ls -la", Dir: "/tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Add(&Execution{Command: "ls -la", Dir: "/tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := s.ResultsDirectory("/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Info.Count != 2 {
+		t.Error("the memory store should keep the history, got", results)
+	}
+
+	// The Store stays open between calls
+	err = s.StoreLastCommand("ls -la")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := s.LastCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ls -la" {
+		t.Error("last command should be ls -la, got", line)
+	}
+}
+
+func TestRewriteWaiting(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s := new(Session)
+	s.BoltPath = f.Name()
+
+	// Open the database while it's being replaced
+	opened := make(chan *BoltStore)
+	err = s.rewrite(func(dst, src Store) error {
+		go func() {
+			store, err := OpenBoltStore(f.Name())
+			if err != nil {
+				t.Error(err)
+			}
+			opened <- store
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		return dst.Update(func(tx Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte("new"))
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := <-opened
+	if store == nil {
+		return
+	}
+	defer store.Close()
+
+	err = store.View(func(tx Tx) error {
+		if tx.Bucket([]byte("new")) == nil {
+			return errors.New("the waiting store should have the new database open")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,527 @@
+package r
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	syncBucket      = "SyncBucket"      // BoltDB bucket storing the command info of each origin, one nested bucket per origin
+	watermarkBucket = "WatermarkBucket" // BoltDB bucket storing how far the history of each peer was synced
+	originKey       = "origin"          // Key in the metaBucket storing the origin of this database
+
+	// syncVersion is the version of the sync protocol
+	syncVersion = 1
+
+	// syncOverlap is how long before the watermark entries are sent again
+	// in case a clock went back. Entries received twice change nothing
+	syncOverlap = time.Minute
+)
+
+// syncEntry is the command info an origin has for a command in the
+// global, a directory or a repository history. Count is only the uses
+// made on the origin itself. Modified is when the entry last changed, on
+// the clock of the database sending it
+type syncEntry struct {
+	Record
+	Origin   string    `json:"origin,omitempty"`
+	Modified time.Time `json:"modified"`
+}
+
+// key returns the key of the entry in its origin bucket
+func (e *syncEntry) key() []byte {
+	return []byte(strings.Join(e.names(), "\x00") + "\x00" + e.Command)
+}
+
+// syncMessage is sent by both ends of a sync at every step
+type syncMessage struct {
+	Origin  string       `json:"origin,omitempty"`
+	Version int          `json:"version,omitempty"`
+	Since   time.Time    `json:"since"`
+	Entries []*syncEntry `json:"entries,omitempty"`
+}
+
+// Sync exchanges history with the database at the other end of rw, which
+// runs Sync too. Each database has a random origin and counts the uses
+// made on every origin apart, so the uses of a command on both ends add
+// up and syncing again, or through a third database, doesn't count a
+// use twice. The latest use wins. Only the entries changed since the
+// last sync with the peer are sent. It returns how many entries were
+// sent and how many of the received ones changed the history
+func (s *Session) Sync(rw io.ReadWriter) (int, int, error) {
+	enc := json.NewEncoder(rw)
+	dec := json.NewDecoder(rw)
+
+	// Both ends write before reading so the writes
+	// can't wait on each other
+	exchange := func(msg *syncMessage) (*syncMessage, error) {
+		errc := make(chan error, 1)
+		go func() {
+			errc <- enc.Encode(msg)
+		}()
+
+		peer := new(syncMessage)
+		err := dec.Decode(peer)
+		if err != nil {
+			return nil, fmt.Errorf("sync: %s", err)
+		}
+
+		return peer, <-errc
+	}
+
+	origin, err := s.syncOrigin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	hello, err := exchange(&syncMessage{Origin: origin, Version: syncVersion})
+	if err != nil {
+		return 0, 0, err
+	}
+	if hello.Version != syncVersion {
+		return 0, 0, fmt.Errorf("sync: peer speaks version %d, this r speaks version %d", hello.Version, syncVersion)
+	}
+	if hello.Origin == "" || hello.Origin == origin {
+		return 0, 0, fmt.Errorf("sync: peer has the same origin %q", hello.Origin)
+	}
+
+	since, err := s.syncSince(hello.Origin)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	peerSince, err := exchange(&syncMessage{Since: since})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	entries, err := s.syncDelta(hello.Origin, peerSince.Since)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	delta, err := exchange(&syncMessage{Entries: entries})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	received, err := s.syncApply(hello.Origin, delta.Entries)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(entries), received, nil
+}
+
+// syncOrigin returns the origin of the database
+func (s *Session) syncOrigin() (string, error) {
+	if resp, ok, err := s.remote(&request{Op: "sync-origin"}); ok {
+		if err != nil {
+			return "", err
+		}
+		return resp.Origin, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return "", err
+	}
+
+	var origin string
+	err = db.Update(func(tx Tx) error {
+		origin, err = readOrigin(tx)
+		return err
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return "", err
+	}
+
+	return origin, nil
+}
+
+// readOrigin returns the origin stored in the metaBucket,
+// choosing one the first time
+func readOrigin(tx Tx) (string, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return "", err
+	}
+
+	if v := b.Get([]byte(originKey)); v != nil {
+		return string(v), nil
+	}
+
+	buf := make([]byte, 16)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	origin := hex.EncodeToString(buf)
+	return origin, b.Put([]byte(originKey), []byte(origin))
+}
+
+// syncSince returns the time the entries of peer have to be
+// sent from, on the clock of peer
+func (s *Session) syncSince(peer string) (time.Time, error) {
+	if resp, ok, err := s.remote(&request{Op: "sync-since", Peer: peer}); ok {
+		if err != nil {
+			return time.Time{}, err
+		}
+		return resp.Since, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var since time.Time
+	err = db.View(func(tx Tx) error {
+		since, err = readWatermark(tx, peer)
+		return err
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if since.IsZero() {
+		return since, nil
+	}
+	return since.Add(-syncOverlap), nil
+}
+
+// readWatermark returns the latest change received from peer
+func readWatermark(tx Tx, peer string) (time.Time, error) {
+	var t time.Time
+	b := tx.Bucket([]byte(watermarkBucket))
+	if b == nil {
+		return t, nil
+	}
+
+	v := b.Get([]byte(peer))
+	if v == nil {
+		return t, nil
+	}
+
+	err := t.UnmarshalText(v)
+	return t, err
+}
+
+// syncDelta returns the entries of every origin but peer changed
+// after since. The entries of this database's origin are brought up
+// to date with the history first
+func (s *Session) syncDelta(peer string, since time.Time) ([]*syncEntry, error) {
+	if resp, ok, err := s.remote(&request{Op: "sync-delta", Peer: peer, Since: since}); ok {
+		if err != nil {
+			return nil, err
+		}
+		return resp.Entries, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*syncEntry
+	err = db.Update(func(tx Tx) error {
+		origin, err := readOrigin(tx)
+		if err != nil {
+			return err
+		}
+
+		err = updateOwnEntries(tx, origin)
+		if err != nil {
+			return err
+		}
+
+		root := tx.Bucket([]byte(syncBucket))
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(o, v []byte) error {
+			if v != nil || string(o) == peer {
+				return nil
+			}
+
+			return root.Bucket(o).ForEach(func(k, v []byte) error {
+				e := new(syncEntry)
+				err := json.Unmarshal(v, e)
+				if err != nil {
+					return err
+				}
+
+				if e.Modified.After(since) {
+					e.Origin = string(o)
+					entries = append(entries, e)
+				}
+				return nil
+			})
+		})
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// updateOwnEntries stores the uses of every command made on origin, the
+// count of its command info less the uses received from other origins
+func updateOwnEntries(tx Tx, origin string) error {
+	root, err := tx.CreateBucketIfNotExists([]byte(syncBucket))
+	if err != nil {
+		return err
+	}
+
+	own, err := root.CreateBucketIfNotExists([]byte(origin))
+	if err != nil {
+		return err
+	}
+
+	var others []Bucket
+	err = root.ForEach(func(o, v []byte) error {
+		if v == nil && string(o) != origin {
+			others = append(others, root.Bucket(o))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var changed []*syncEntry
+	err = forEachInfoBucket(tx, func(names []string, b Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil || string(k) == hookArtifact {
+				return nil
+			}
+
+			ci := new(CommandInfo).NewFromString(string(v))
+			e := &syncEntry{Record: *newRecord(names, string(k), ci)}
+			key := e.key()
+			for _, other := range others {
+				if prev := readEntry(other, key); prev != nil {
+					e.Count -= prev.Count
+				}
+			}
+			if e.Count < 0 {
+				e.Count = 0
+			}
+
+			// Counts only grow, even when the command info was pruned
+			prev := readEntry(own, key)
+			if prev != nil && e.Count < prev.Count {
+				e.Count = prev.Count
+			}
+			if prev == nil && e.Count == 0 {
+				return nil
+			}
+			if prev != nil && prev.Count == e.Count && prev.Time.Equal(e.Time) && prev.Exit == e.Exit {
+				return nil
+			}
+
+			changed = append(changed, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range changed {
+		e.Modified = now
+		err = writeEntry(own, e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readEntry returns the entry stored at key of an origin bucket
+// or nil when it isn't stored
+func readEntry(b Bucket, key []byte) *syncEntry {
+	v := b.Get(key)
+	if v == nil {
+		return nil
+	}
+
+	e := new(syncEntry)
+	if json.Unmarshal(v, e) != nil {
+		return nil
+	}
+	return e
+}
+
+// writeEntry stores e in its origin bucket
+func writeEntry(b Bucket, e *syncEntry) error {
+	stored := *e
+	stored.Origin = ""
+	v, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(e.key(), v)
+}
+
+// syncApply merges the entries received from peer into the history. Only
+// the uses an origin made since its entry was last received are added to
+// the counts. It returns how many entries changed the history
+func (s *Session) syncApply(peer string, entries []*syncEntry) (int, error) {
+	if resp, ok, err := s.remote(&request{Op: "sync-apply", Peer: peer, Entries: entries}); ok {
+		if err != nil {
+			return 0, err
+		}
+		return resp.Count, nil
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return 0, err
+	}
+
+	var applied int
+	err = db.Update(func(tx Tx) error {
+		applied, err = s.applyEntries(tx, peer, entries)
+		return err
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return applied, nil
+}
+
+// applyEntries merges entries in tx, moves the watermark of
+// peer to the latest change received then prunes
+func (s *Session) applyEntries(tx Tx, peer string, entries []*syncEntry) (int, error) {
+	origin, err := readOrigin(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	watermark, err := readWatermark(tx, peer)
+	if err != nil {
+		return 0, err
+	}
+
+	root, err := tx.CreateBucketIfNotExists([]byte(syncBucket))
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	dirs := make(map[string]bool)
+	repos := make(map[string]bool)
+	now := time.Now()
+	for _, e := range entries {
+		if e.Modified.After(watermark) {
+			watermark = e.Modified
+		}
+
+		// Entries are only stored for live command info and
+		// the uses of this database are already counted
+		if e.Origin == "" || e.Origin == origin || e.Archived || e.Command == "" {
+			continue
+		}
+
+		b, err := root.CreateBucketIfNotExists([]byte(e.Origin))
+		if err != nil {
+			return 0, err
+		}
+
+		// Counts only grow so the uses not received yet are the difference
+		uses := e.Count
+		stored := *e
+		if prev := readEntry(b, e.key()); prev != nil {
+			if e.Count <= prev.Count && !e.Time.After(prev.Time) {
+				continue
+			}
+
+			uses -= prev.Count
+			if uses < 0 {
+				uses = 0
+			}
+
+			merged := mergeInfo(&CommandInfo{Time: prev.Time, Count: prev.Count, Exit: prev.Exit},
+				&CommandInfo{Time: e.Time, Count: e.Count, Exit: e.Exit})
+			stored.Count, stored.Time, stored.Exit = merged.Count, merged.Time, merged.Exit
+		}
+
+		ib, err := openInfo(tx, true, e.names()...)
+		if err != nil {
+			return 0, err
+		}
+
+		ci := ib.get(e.Command)
+		if ci == nil {
+			ci = new(CommandInfo)
+		}
+		ci.Count += uses
+		if e.Time.After(ci.Time) {
+			ci.Time = e.Time
+			ci.Exit = e.Exit
+		}
+
+		err = ib.put(e.Command, ci)
+		if err != nil {
+			return 0, err
+		}
+
+		stored.Modified = now
+		err = writeEntry(b, &stored)
+		if err != nil {
+			return 0, err
+		}
+
+		applied++
+		if e.Dir != "" {
+			dirs[e.Dir] = true
+		}
+		if e.Repo != "" {
+			repos[e.Repo] = true
+		}
+	}
+
+	if !watermark.IsZero() {
+		b, err := tx.CreateBucketIfNotExists([]byte(watermarkBucket))
+		if err != nil {
+			return 0, err
+		}
+
+		v, err := watermark.MarshalText()
+		if err != nil {
+			return 0, err
+		}
+
+		err = b.Put([]byte(peer), v)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return applied, s.pruneScopes(tx, dirs, repos)
+}
@@ -0,0 +1,121 @@
+package r
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	newSession := func() *Session {
+		s := new(Session)
+		s.Store = NewMemoryStore()
+		return s
+	}
+	a, b, c := newSession(), newSession(), newSession()
+
+	start := time.Now().Add(-time.Hour)
+	use := func(s *Session, n int) {
+		for i := 0; i < n; i++ {
+			start = start.Add(time.Minute)
+			err := s.AddRun("ls -a", &Run{Dir: "/tmp", Start: start})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sync := func(x, y *Session) int {
+		cx, cy := net.Pipe()
+		defer cx.Close()
+		defer cy.Close()
+
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := y.Sync(cy)
+			errc <- err
+		}()
+
+		_, received, err := x.Sync(cx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		return received
+	}
+
+	count := func(s *Session) int {
+		results := mustResults(t)(s.ResultsDirectory("/tmp"))
+		if len(results) != 1 {
+			t.Fatal("sync should keep the directory history, got", namesOfCmds(results))
+		}
+		global := mustResults(t)(s.ResultsGlobal())
+		if len(global) != 1 || global[0].Info.Count != results[0].Info.Count {
+			t.Fatal("sync should update the global history too")
+		}
+		return results[0].Info.Count
+	}
+
+	use(a, 2)
+	use(b, 1)
+	sync(a, b)
+	if count(a) != 3 || count(b) != 3 {
+		t.Errorf("uses on both ends should add up to 3, got %d and %d", count(a), count(b))
+	}
+
+	if received := sync(a, b); received != 0 || count(a) != 3 || count(b) != 3 {
+		t.Errorf("syncing again should change nothing, received %d", received)
+	}
+
+	// The uses of a reach c through b and
+	// then reach b again from c
+	sync(c, b)
+	use(a, 1)
+	sync(a, c)
+	sync(b, c)
+	sync(a, b)
+	for i, s := range []*Session{a, b, c} {
+		if got := count(s); got != 4 {
+			t.Errorf("database %d: count should be 4, got %d", i, got)
+		}
+	}
+
+	self := selfPipe(t)
+	defer self.Close()
+	if _, _, err := a.Sync(self); err == nil {
+		t.Error("syncing a database with itself should fail")
+	}
+}
+
+// selfPipe returns a connection that reads back what's written to it
+func selfPipe(t *testing.T) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			conn.Write(buf[:n])
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
@@ -0,0 +1,193 @@
+package r
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultRootMarkers are the files marking the root of a project
+var defaultRootMarkers = []string{".git", ".hg", ".svn"}
+
+// byDistance sorts commands from the nearest directory first
+type byDistance []*Command
+
+// Len used for sorting
+func (s byDistance) Len() int {
+	return len(s)
+}
+
+// Less used for sorting
+func (s byDistance) Less(i, j int) bool {
+	return s[i].Distance < s[j].Distance
+}
+
+// Swap used for sorting
+func (s byDistance) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// rootMarkers returns the Session's root markers, then the colon
+// separated list in R_ROOTMARKERS and then the defaults
+func (s *Session) rootMarkers() []string {
+	if len(s.RootMarkers) > 0 {
+		return s.RootMarkers
+	}
+
+	if env := s.getenv("R_ROOTMARKERS"); env != "" {
+		return strings.Split(env, ":")
+	}
+
+	return defaultRootMarkers
+}
+
+// ProjectRoot returns the nearest directory from path up that contains
+// one of the root markers. It returns an empty string when path isn't
+// inside a project
+func (s *Session) ProjectRoot(path string) string {
+	dir := filepath.Clean(path)
+	for {
+		for _, marker := range s.rootMarkers() {
+			if exists(filepath.Join(dir, marker)) {
+				return dir
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// ancestors returns path and its parents up to the project root.
+// Outside of a project it only returns path
+func (s *Session) ancestors(path string) []string {
+	dir := filepath.Clean(path)
+	dirs := []string{dir}
+
+	root := s.ProjectRoot(dir)
+	if root == "" {
+		return dirs
+	}
+
+	for dir != root {
+		dir = filepath.Dir(dir)
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
+
+// readDirectory returns the commands stored for dir labelled with the
+// directory and its distance from the current directory
+func readDirectory(b Bucket, dir string, distance int) []*Command {
+	pathBucket := b.Bucket([]byte(dir))
+	if pathBucket == nil {
+		return nil
+	}
+
+	var results []*Command
+	pathBucket.ForEach(func(k, v []byte) error {
+		if string(k) == hookArtifact {
+			return nil
+		}
+
+		cmd := new(Command)
+		cmd.Name = string(k)
+		cmd.Info = new(CommandInfo).NewFromString(string(v))
+		cmd.Dir = dir
+		cmd.Distance = distance
+		results = append(results, cmd)
+		return nil
+	})
+
+	return results
+}
+
+// ResultsTree returns the command history of path merged with its parent
+// directories up to the project root and, when Descendants is set, its
+// child directories. Each command is labelled with the directory it came
+// from and ranked lower the further that directory is from path. A command
+// found in several directories is only kept for the nearest
+func (s *Session) ResultsTree(path string) ([]*Command, error) {
+	path = filepath.Clean(path)
+	if resp, ok, err := s.remote(&request{Op: "results-tree", Path: path}); ok {
+		return resp.commands(err)
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*Command
+	err = db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte(directoryBucket))
+		if b == nil {
+			return nil
+		}
+
+		// Directories are read in a fixed order, nearest first, so ties
+		// keep the same order between calls
+		var byDir [][]*Command
+		var dirs []string
+		for distance, dir := range s.ancestors(path) {
+			byDir = append(byDir, readDirectory(b, dir, distance))
+			dirs = append(dirs, dir)
+		}
+
+		if s.Descendants {
+			prefix := path + string(filepath.Separator)
+			if path == string(filepath.Separator) {
+				prefix = path
+			}
+
+			c := b.Cursor()
+			for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+				dir := string(k)
+				rel := strings.TrimPrefix(dir, prefix)
+				distance := strings.Count(rel, string(filepath.Separator)) + 1
+				byDir = append(byDir, readDirectory(b, dir, distance))
+				dirs = append(dirs, dir)
+			}
+		}
+
+		for i, cmds := range byDir {
+			err := s.scoreFrecency(tx, cmds, inDir(dirs[i]))
+			if err != nil {
+				return err
+			}
+
+			results = append(results, cmds...)
+		}
+
+		return nil
+	})
+
+	s.close(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort commands then group them from the nearest directory out
+	s.sortCommands(results)
+	sort.Stable(byDistance(results))
+
+	// Filter before merging so a command failing in a nearer directory
+	// doesn't hide where it succeeded
+	seen := make(map[string]bool)
+	var merged []*Command
+	for _, cmd := range s.filterCommands(results) {
+		if seen[cmd.Name] {
+			continue
+		}
+		seen[cmd.Name] = true
+		merged = append(merged, cmd)
+	}
+
+	return s.limitCommands(merged), nil
+}